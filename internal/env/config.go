@@ -10,9 +10,19 @@ import (
 )
 
 type Config struct {
-	SupervisorProjectPath string `env:"SUPERVISOR_DOCKER_PROJECT_PATH"`
-	SupervisorComposeFile string `env:"SUPERVISOR_DOCKER_COMPOSE_FILE"`
-	SupervisorConfigFile  string `env:"SUPERVISOR_CONFIG_FILE"`
+	SupervisorProjectPath       string   `env:"SUPERVISOR_DOCKER_PROJECT_PATH"`
+	SupervisorComposeFiles      []string `env:"SUPERVISOR_DOCKER_COMPOSE_FILE"`
+	SupervisorConfigFile        string   `env:"SUPERVISOR_CONFIG_FILE"`
+	SupervisorProfiles          []string `env:"SUPERVISOR_PROFILES"`
+	SupervisorImageHistory      int      `env:"SUPERVISOR_IMAGE_HISTORY,default=3"`
+	SupervisorBuildWorkers      int      `env:"SUPERVISOR_BUILD_WORKERS,default=2"`
+	SupervisorBuildLogDir       string   `env:"SUPERVISOR_BUILD_LOG_DIR,default=/supervisor/builds"`
+	SupervisorBuildContextLimit int64    `env:"SUPERVISOR_BUILD_CONTEXT_LIMIT,default=500"`
+	SupervisorExportProject     bool     `env:"SUPERVISOR_EXPORT_PROJECT,default=false"`
+	SupervisorSecretsDir        string   `env:"SUPERVISOR_SECRETS_DIR,default=/run/ros-supervisor/secrets"`
+	SupervisorSecretsHostDir    string   `env:"SUPERVISOR_SECRETS_HOST_DIR"`
+	SupervisorDependencyTimeout int      `env:"SUPERVISOR_DEPENDENCY_TIMEOUT,default=300"`
+	SupervisorUpdateTimeout     int      `env:"SUPERVISOR_UPDATE_TIMEOUT,default=300"`
 
 	GitAccessToken string `env:"GITHUB_ACCESS_TOKEN"`
 	UpdateFreq     string `env:"UPDATE_FREQUENCY"`
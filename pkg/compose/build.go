@@ -5,135 +5,444 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
-	"github.com/docker/cli/cli"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/builder/remotecontext/git"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/pools"
+	"github.com/docker/docker/pkg/urlutil"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-func BuildAll(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) error {
+// Number of images prepared at the same time
+var BuildWorkers = 2
 
-	err := BuildCore(ctx, dockerClient, project, logger)
-	if err != nil {
-		return err
+// BuildResult is the outcome of preparing the image of a service
+type BuildResult struct {
+	Service  string
+	ImageID  string
+	Duration time.Duration
+	Err      error
+}
+
+type BuildResults []BuildResult
+
+// Combined error of the services whose image could not be prepared, nil if
+// every image is ready
+func (results BuildResults) Err() error {
+	failed := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Service, result.Err))
+		}
 	}
-	err = BuildServices(ctx, dockerClient, project, logger)
-	if err != nil {
-		return err
+	if len(failed) == 0 {
+		return nil
 	}
-	return nil
+	return errors.Errorf("unable to prepare the images of %d services: %s", len(failed), strings.Join(failed, "; "))
 }
 
-func BuildCore(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) error {
-	logger.Info("Building core")
-	_, err := BuildSingle(ctx, dockerClient, project.Name, &project.Core, logger)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Unable to build core with errror: %s", err))
-		return err
-	}
-	return nil
+func BuildAll(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) (BuildResults, error) {
+	logger.Info("Building core and services")
+	return BuildImages(ctx, dockerClient, project.Name, desiredServices(project), logger)
 }
 
-func BuildServices(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) error {
+func BuildServices(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) (BuildResults, error) {
 	logger.Info("Building services")
+	services := []*docker.Service{}
 	for idx := range project.Services {
-		_, err := BuildSingle(ctx, dockerClient, project.Name, &project.Services[idx], logger)
+		if !project.IsServiceEnabled(&project.Services[idx]) {
+			logger.Info(fmt.Sprintf("Skipping service %s disabled by the active profiles", project.Services[idx].Name))
+			continue
+		}
+		services = append(services, &project.Services[idx])
+	}
+	return BuildImages(ctx, dockerClient, project.Name, services, logger)
+}
+
+// Prepare the images of the given services with up to BuildWorkers images at
+// a time. A service whose Dockerfile starts from the image of another service,
+// or built from git after the services it depends on, waits for those images,
+// and is skipped if they could not be prepared. Every
+// service gets a result, in the order they are given
+func BuildImages(ctx context.Context, dockerClient *client.Client, projectName string, services []*docker.Service, logger *zap.Logger) (BuildResults, error) {
+	for _, targetService := range services {
+		if targetService.HasBuild() {
+			setDefaultImageName(projectName, targetService)
+		}
+	}
+	graph := DependencyGraph{dependencies: buildDependencies(services, logger)}
+	if _, err := graph.TopologicalOrder(); err != nil {
+		return nil, err
+	}
+
+	workers := BuildWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	done := map[string]chan struct{}{}
+	for _, targetService := range services {
+		done[targetService.Name] = make(chan struct{})
+	}
+
+	results := make(BuildResults, len(services))
+	failed := map[string]bool{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for idx, targetService := range services {
+		wg.Add(1)
+		go func(idx int, targetService *docker.Service) {
+			defer wg.Done()
+			defer close(done[targetService.Name])
+			result := BuildResult{Service: targetService.Name}
+			defer func() {
+				mutex.Lock()
+				results[idx] = result
+				failed[targetService.Name] = result.Err != nil
+				mutex.Unlock()
+			}()
+
+			for _, dependency := range graph.dependencies[targetService.Name] {
+				<-done[dependency]
+				mutex.Lock()
+				dependencyFailed := failed[dependency]
+				mutex.Unlock()
+				if dependencyFailed {
+					result.Err = errors.Errorf("base image of service %s could not be prepared", dependency)
+					return
+				}
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				result.Err = ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			result.Err = PrepareServiceImage(ctx, dockerClient, projectName, targetService, logger)
+			result.Duration = time.Since(start)
+			result.ImageID = targetService.Image.ID
+			if result.Err != nil {
+				logger.Error(fmt.Sprintf("Unable to prepare image of service %s with error: %s", targetService.Name, result.Err))
+				return
+			}
+			logger.Info(fmt.Sprintf("Image of service %s is ready in %s", targetService.Name, result.Duration))
+		}(idx, targetService)
+	}
+	wg.Wait()
+	return results, results.Err()
+}
+
+// Map every service to the services whose image its Dockerfile starts from.
+// The Dockerfile of a git context cannot be read before the build, so such a
+// service is built after the services it depends on instead
+func buildDependencies(services []*docker.Service, logger *zap.Logger) map[string][]string {
+	imageOwners := map[string]string{}
+	building := map[string]bool{}
+	for _, targetService := range services {
+		building[targetService.Name] = true
+		if targetService.Image.Name != "" {
+			imageOwners[normalizeImageRef(targetService.Image.Reference())] = targetService.Name
+		}
+	}
+
+	dependencies := map[string][]string{}
+	for _, targetService := range services {
+		dependencies[targetService.Name] = []string{}
+		if !targetService.HasBuild() {
+			continue
+		}
+		if isGitContext(targetService) {
+			logger.Info(fmt.Sprintf("Base images of service %s are unknown as it is built from git, building it after its dependencies", targetService.Name))
+			for _, dependency := range targetService.DependsOn {
+				if building[dependency.Name] && dependency.Name != targetService.Name {
+					dependencies[targetService.Name] = append(dependencies[targetService.Name], dependency.Name)
+				}
+			}
+			continue
+		}
+		baseImages, err := dockerfileBaseImages(targetService)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Unable to build service %s with errror: %s", project.Services[idx].Name, err))
-			return err
+			logger.Warn(fmt.Sprintf("Unable to read the base images of service %s with error: %s", targetService.Name, err))
+			continue
+		}
+		seen := map[string]bool{}
+		for _, baseImage := range baseImages {
+			owner, ok := imageOwners[normalizeImageRef(baseImage)]
+			if !ok || owner == targetService.Name || seen[owner] {
+				continue
+			}
+			seen[owner] = true
+			dependencies[targetService.Name] = append(dependencies[targetService.Name], owner)
 		}
 	}
-	return nil
+	return dependencies
 }
 
-func BuildSingle(ctx context.Context, dockerClient *client.Client, projectName string, targetService *docker.Service, logger *zap.Logger) (string, error) {
+// Images named by the FROM instructions of the Dockerfile of a service. Stages
+// built from an earlier stage are left out, and build arguments are replaced
+// by their value
+func dockerfileBaseImages(targetService *docker.Service) ([]string, error) {
+	// The Dockerfile of a git context is only known once it is cloned
+	if isGitContext(targetService) {
+		return nil, nil
+	}
+	dockerfile := targetService.BuildOpt.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	if !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(targetService.BuildOpt.Context, dockerfile)
+	}
+	content, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	args := map[string]string{}
+	stages := map[string]bool{}
+	images := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if len(images) > 0 {
+				continue
+			}
+			parts := strings.SplitN(fields[1], "=", 2)
+			if len(parts) == 2 {
+				args[parts[0]] = strings.Trim(parts[1], "\"'")
+			}
+		case "FROM":
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+				fields = fields[1:]
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			image := os.Expand(fields[0], func(key string) string {
+				if value, ok := targetService.BuildOpt.Args[key]; ok && value != nil {
+					return *value
+				}
+				return args[key]
+			})
+			if !stages[image] {
+				images = append(images, image)
+			}
+			if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+				stages[fields[2]] = true
+			}
+		}
+	}
+	return images, nil
+}
+
+// Image reference with the default tag made explicit
+func normalizeImageRef(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	if strings.LastIndex(ref, ":") <= strings.LastIndex(ref, "/") {
+		return ref + ":latest"
+	}
+	return ref
+}
 
-	logger.Info(fmt.Sprintf("Building service %s", targetService.Name))
-	// TODO Investigate build context as a git repo
-	buildCtx, err := PrepareLocalBuildContext(projectName, targetService, &archive.TarOptions{}, logger)
+// Build the image of a service and attach its id to the service. The output
+// of the build is stored in a build log, see ListBuilds
+func BuildSingle(ctx context.Context, dockerClient *client.Client, projectName string, targetService *docker.Service, logger *zap.Logger) (string, error) {
+	setDefaultImageName(projectName, targetService)
+	buildLog, err := startBuildLog(projectName, targetService)
 	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to record build of service %s with error: %s", targetService.Name, err))
+		return "", err
+	}
+	logger.Info(fmt.Sprintf("Building service %s with build id %s", targetService.Name, buildLog.record.ID))
 
+	imageID, err := buildImage(ctx, dockerClient, projectName, targetService, buildLog, logger)
+	if err != nil {
+		buildLog.Printf("ERROR: %s\n", err)
+		logger.Error(fmt.Sprintf("Unable to build service %s with error: %s", targetService.Name, err))
+	} else {
+		targetService.Image.ID = imageID
+		logger.Info(fmt.Sprintf("Built image %s of service %s", imageID, targetService.Name))
+	}
+	if finishErr := buildLog.finish(imageID, err); finishErr != nil {
+		logger.Error(fmt.Sprintf("Unable to record build of service %s with error: %s", targetService.Name, finishErr))
 	}
+	return imageID, err
+}
+
+func buildImage(ctx context.Context, dockerClient *client.Client, projectName string, targetService *docker.Service, buildLog *buildLog, logger *zap.Logger) (string, error) {
+	var buildCtx io.ReadCloser
+	var err error
 	buildOpts := PrepareImageBuildOptions(projectName, targetService)
+	if isGitContext(targetService) {
+		gitURL := gitContextAt(targetService.BuildOpt.Context, targetService.BuildOpt.Revision)
+		buildLog.Printf("Building %s from %s with tags %s\n", targetService.Name, gitURL, strings.Join(buildOpts.Tags, ", "))
+		buildCtx, err = PrepareGitBuildContext(targetService.BuildOpt.Context, targetService.BuildOpt.Dockerfile, targetService, &archive.TarOptions{}, logger)
+	} else {
+		buildLog.Printf("Building %s from %s with tags %s\n", targetService.Name, targetService.BuildOpt.Context, strings.Join(buildOpts.Tags, ", "))
+		buildCtx, err = PrepareLocalBuildContext(projectName, targetService, &archive.TarOptions{}, logger)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "unable to prepare build context")
+	}
+	defer buildCtx.Close()
 	response, err := dockerClient.ImageBuild(ctx, buildCtx, buildOpts)
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Error: %s", err))
+		return "", err
 	}
 	defer response.Body.Close()
 
 	imageID := ""
-	progBuff := os.Stdout
-	buildBuff := os.Stdout
-	aux := func(msg jsonmessage.JSONMessage) {
-		var result types.BuildResult
-		if err := json.Unmarshal(*msg.Aux, &result); err != nil {
-			logger.Error(fmt.Sprintf("Failed to parse aux message: %s", err))
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", errors.Wrap(err, "unable to decode build output")
+		}
+		if msg.Error != nil {
+			return "", msg.Error
+		}
+		// The id of the built image is sent as an auxiliary message
+		if msg.Aux != nil {
+			var result types.BuildResult
+			if err := json.Unmarshal(*msg.Aux, &result); err == nil && result.ID != "" {
+				imageID = result.ID
+			}
+			continue
+		}
+		if msg.Stream != "" {
+			buildLog.Write([]byte(msg.Stream))
+			logger.Debug(fmt.Sprintf("%s: %s", targetService.Name, strings.TrimRight(msg.Stream, "\n")))
+			continue
+		}
+		// Skip the progress bars of the base images being pulled
+		if msg.Progress != nil || msg.Status == "" {
+			continue
+		}
+		if msg.ID != "" {
+			buildLog.Printf("%s: %s\n", msg.ID, msg.Status)
 		} else {
-			logger.Info(fmt.Sprintf("%s", msg.Stream))
+			buildLog.Printf("%s\n", msg.Status)
 		}
 	}
 
-	// Attach imageID to Service.Image
-
-	targetService.Image.ID = imageID
-	targetService.Image.Name = projectName + "_" + targetService.Name
-	targetService.Image.Tag = "v0.0.1"
-
-	// We need to figure out a way to read message from Message Stream and log those message for debugging build process
-	err = jsonmessage.DisplayJSONMessagesStream(response.Body, buildBuff, progBuff.Fd(), true, aux)
-	if err != nil {
-		if jerr, ok := err.(*jsonmessage.JSONError); ok {
-			// If no error code is set, default to 1
-			if jerr.Code == 0 {
-				jerr.Code = 1
-			}
-			return "", cli.StatusError{Status: jerr.Message, StatusCode: jerr.Code}
+	// Older daemons do not send the id of the image
+	if imageID == "" {
+		if _, err := ImageExists(ctx, dockerClient, targetService, logger); err != nil {
+			return "", err
 		}
-		return "", err
+		imageID = targetService.Image.ID
 	}
-
 	return imageID, nil
 }
 
+// Built images are named after the project and service unless the service
+// specifies an image name explicitly
+func setDefaultImageName(projectName string, targetService *docker.Service) {
+	if targetService.Image.Name == "" {
+		targetService.Image.Name = projectName + "_" + targetService.Name
+		targetService.Image.Tag = "latest"
+	}
+}
+
 // LOCAL BUILD CONTEXT
 func PrepareLocalBuildContext(projectName string, targetService *docker.Service, archiveOpts *archive.TarOptions, logger *zap.Logger) (io.ReadCloser, error) {
-
-	// Initial archiving
-	archiveCtx, err := archive.TarWithOptions(targetService.BuildOpt.Context, archiveOpts)
+	buildCtx, err := archiveBuildContext(targetService.Name, targetService.BuildOpt.Context, targetService.BuildOpt.Dockerfile, archiveOpts, logger)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Unable to create local build context with error: %s", err))
 		return nil, err
 	}
+	return buildCtx, nil
+}
 
-	// Compress archiveCtx
-	buildCtx, err := CompressBuiltCtx(archiveCtx)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Unable to compress local build context with error: %s", err))
-		return nil, err
+// Labels of the build section together with the labels identifying the
+// service and the OCI annotations, which take precedence
+func prepareImageLabels(projectName string, targetService *docker.Service) map[string]string {
+	labels := map[string]string{}
+	for key, value := range targetService.BuildOpt.Labels {
+		labels[key] = value
+	}
+	labels[docker.LabelOCITitle] = targetService.Name
+	if targetService.Commit != "" {
+		labels[docker.LabelOCIRevision] = targetService.Commit
+		labels[docker.LabelOCIVersion] = commitTag(targetService.Commit)
+	}
+	for key, value := range serviceLabels(projectName, targetService) {
+		labels[key] = value
 	}
+	return labels
+}
 
-	return buildCtx, nil
+// Tag of the image built from the given commits: the short sha of every
+// commit, joined with dashes
+func commitTag(commit string) string {
+	shas := []string{}
+	for _, sha := range strings.Split(commit, ",") {
+		sha = strings.TrimSpace(sha)
+		if len(sha) > commitTagLength {
+			sha = sha[:commitTagLength]
+		}
+		if sha != "" {
+			shas = append(shas, sha)
+		}
+	}
+	return strings.Join(shas, "-")
+}
+
+const commitTagLength = 12
+
+// Images are tagged with their moving alias, latest unless the service
+// specifies a tag, and with the commits they are built from so that previous
+// images stay available for rollback
+func prepareImageTags(projectName string, targetService *docker.Service) []string {
+	image := targetService.Image
+	if image.Name == "" {
+		image = docker.Image{Name: projectName + "_" + targetService.Name, Tag: "latest"}
+	}
+	tags := []string{image.Reference()}
+	if tag := commitTag(targetService.Commit); tag != "" && tag != image.Tag && image.Digest == "" {
+		tags = append(tags, image.Name+":"+tag)
+	}
+	return tags
 }
 
 func PrepareImageBuildOptions(projectName string, targetService *docker.Service) types.ImageBuildOptions {
-	// Prepare tag
-	tag := []string{projectName + "_" + targetService.Name + ":" + "latest"}
 	return types.ImageBuildOptions{
-		Tags:           tag,
+		Tags:           prepareImageTags(projectName, targetService),
 		SuppressOutput: false,
 		Dockerfile:     targetService.BuildOpt.Dockerfile,
 		BuildArgs:      targetService.BuildOpt.Args,
+		Target:         targetService.BuildOpt.Target,
+		Labels:         prepareImageLabels(projectName, targetService),
+		CacheFrom:      targetService.BuildOpt.CacheFrom,
+		ShmSize:        targetService.BuildOpt.ShmSize,
+		NetworkMode:    targetService.BuildOpt.Network,
+		ExtraHosts:     targetService.BuildOpt.ExtraHosts,
 		Remove:         true,
 	}
 }
@@ -162,39 +471,99 @@ func CompressBuiltCtx(buildCtx io.ReadCloser) (io.ReadCloser, error) {
 }
 
 // GITHUB BUILD CONTEXT
+// Clone a git build context given as repo#ref:subdir and archive the checked
+// out directory. When the service has a revision, the repository is checked
+// out at that commit instead of the ref, and the checkout is verified to
+// match it
 func PrepareGitBuildContext(gitURL string, dockerfileName string, targetService *docker.Service, archiveOpts *archive.TarOptions, logger *zap.Logger) (io.ReadCloser, error) {
 	if _, err := exec.LookPath("git"); err != nil {
 		return nil, errors.Wrapf(err, "unable to find 'git'")
 	}
+	gitURL = gitContextAt(gitURL, targetService.BuildOpt.Revision)
+	logger.Info(fmt.Sprintf("Cloning build context %s of service %s", gitURL, targetService.Name))
 	absContextDir, err := git.Clone(gitURL)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to 'git clone' to temporary context directory")
 	}
+	defer os.RemoveAll(gitCloneRoot(absContextDir))
+
+	if revision := targetService.BuildOpt.Revision; revision != "" {
+		output, err := exec.Command("git", "-C", absContextDir, "rev-parse", "HEAD").Output()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read the commit of the build context")
+		}
+		head := strings.TrimSpace(string(output))
+		if !strings.HasPrefix(head, revision) {
+			return nil, errors.Errorf("build context is checked out at %s instead of %s", head, revision)
+		}
+	}
 
 	absContextDir, err = ResolveAndValidateContextPath(absContextDir)
 	if err != nil {
 		return nil, err
 	}
 	relDockerfile, err := getDockerfileRelPath(absContextDir, dockerfileName)
-	if err == nil && strings.HasPrefix(relDockerfile, ".."+string(filepath.Separator)) {
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(relDockerfile, ".."+string(filepath.Separator)) {
 		return nil, errors.Errorf("the Dockerfile (%s) must be within the build context", dockerfileName)
 	}
 
-	// Initial archiving
-	archiveCtx, err := archive.TarWithOptions(targetService.BuildOpt.Context, archiveOpts)
+	// The archive is written to a temporary file, so the clone can be removed
+	// as soon as it is created
+	buildCtx, err := archiveBuildContext(targetService.Name, absContextDir, relDockerfile, archiveOpts, logger)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Unable to create local build context with error: %s", err))
+		logger.Error(fmt.Sprintf("Unable to create git build context with error: %s", err))
 		return nil, err
 	}
+	return buildCtx, nil
+}
 
-	// Compress archiveCtx
-	buildCtx, err := CompressBuiltCtx(archiveCtx)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Unable to compress local build context with error: %s", err))
-		return nil, err
+// Replace the ref of a git context given as repo#ref:subdir with a commit,
+// keeping the subdirectory
+func gitContextAt(gitURL string, revision string) string {
+	if revision == "" {
+		return gitURL
+	}
+	remote, fragment := gitURL, ""
+	if idx := strings.Index(gitURL, "#"); idx >= 0 {
+		remote, fragment = gitURL[:idx], gitURL[idx+1:]
 	}
+	subdir := ""
+	if idx := strings.Index(fragment, ":"); idx >= 0 {
+		subdir = fragment[idx+1:]
+	}
+	if subdir == "" {
+		return remote + "#" + revision
+	}
+	return remote + "#" + revision + ":" + subdir
+}
 
-	return buildCtx, nil
+// Repository of a git context given as repo#ref:subdir
+func GitContextRemote(gitURL string) string {
+	if idx := strings.Index(gitURL, "#"); idx >= 0 {
+		return gitURL[:idx]
+	}
+	return gitURL
+}
+
+// The docker git helper clones into a docker-build-git temporary directory
+// and returns the subdirectory of the context within it
+func gitCloneRoot(checkoutDir string) string {
+	root := checkoutDir
+	for !strings.HasPrefix(filepath.Base(root), "docker-build-git") {
+		parent := filepath.Dir(root)
+		if parent == root {
+			return checkoutDir
+		}
+		root = parent
+	}
+	return root
+}
+
+func isGitContext(targetService *docker.Service) bool {
+	return urlutil.IsGitURL(targetService.BuildOpt.Context)
 }
 
 func ResolveAndValidateContextPath(givenContextDir string) (string, error) {
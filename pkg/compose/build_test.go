@@ -0,0 +1,150 @@
+package compose
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"go.uber.org/zap"
+)
+
+// Create a build context holding the given Dockerfile and return a service
+// built from it
+func buildService(t *testing.T, name string, image string, dockerfile string) *docker.Service {
+	context, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(context) })
+	if err := ioutil.WriteFile(filepath.Join(context, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &docker.Service{
+		Name:     name,
+		Image:    docker.Image{Name: image, Tag: "latest"},
+		BuildOpt: docker.ServiceBuild{Context: context},
+	}
+}
+
+func TestDockerfileBaseImages(t *testing.T) {
+	version := "noetic"
+	tests := []struct {
+		name       string
+		dockerfile string
+		args       map[string]*string
+		expected   []string
+	}{
+		{
+			name:       "single stage",
+			dockerfile: "FROM ros:noetic\nRUN true\n",
+			expected:   []string{"ros:noetic"},
+		},
+		{
+			name:       "stages built from an earlier stage are left out",
+			dockerfile: "FROM ros:noetic AS base\nFROM base\nFROM --platform=linux/amd64 alpine AS tools\n",
+			expected:   []string{"ros:noetic", "alpine"},
+		},
+		{
+			name:       "build arguments are replaced by their value",
+			dockerfile: "ARG DISTRO=melodic\nFROM ros:${DISTRO}\n",
+			expected:   []string{"ros:melodic"},
+		},
+		{
+			name:       "arguments of the service take precedence",
+			dockerfile: "ARG DISTRO=melodic\nFROM ros:$DISTRO\n",
+			args:       map[string]*string{"DISTRO": &version},
+			expected:   []string{"ros:noetic"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			targetService := buildService(t, "app", "app", test.dockerfile)
+			targetService.BuildOpt.Args = test.args
+			images, err := dockerfileBaseImages(targetService)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(images, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, images)
+			}
+		})
+	}
+}
+
+func TestBuildOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		services func(t *testing.T) []*docker.Service
+		expected []string
+		cycle    bool
+	}{
+		{
+			name: "services are built after the images they start from",
+			services: func(t *testing.T) []*docker.Service {
+				return []*docker.Service{
+					buildService(t, "app", "project_app", "FROM project_base:latest\n"),
+					buildService(t, "base", "project_base", "FROM ros:noetic\n"),
+					buildService(t, "tools", "project_tools", "FROM project_base\n"),
+				}
+			},
+			expected: []string{"base", "app", "tools"},
+		},
+		{
+			name: "independent services are ordered by name",
+			services: func(t *testing.T) []*docker.Service {
+				return []*docker.Service{
+					buildService(t, "b", "project_b", "FROM alpine\n"),
+					buildService(t, "a", "project_a", "FROM alpine\n"),
+				}
+			},
+			expected: []string{"a", "b"},
+		},
+		{
+			name: "git contexts are built after their dependencies",
+			services: func(t *testing.T) []*docker.Service {
+				remote := &docker.Service{
+					Name:      "remote",
+					Image:     docker.Image{Name: "project_remote", Tag: "latest"},
+					BuildOpt:  docker.ServiceBuild{Context: "https://github.com/example/remote.git"},
+					DependsOn: []docker.ServiceDependency{{Name: "base"}, {Name: "database"}},
+				}
+				return []*docker.Service{
+					remote,
+					buildService(t, "base", "project_base", "FROM ros:noetic\n"),
+				}
+			},
+			expected: []string{"base", "remote"},
+		},
+		{
+			name: "services starting from each other form a cycle",
+			services: func(t *testing.T) []*docker.Service {
+				return []*docker.Service{
+					buildService(t, "a", "project_a", "FROM project_b\n"),
+					buildService(t, "b", "project_b", "FROM project_a\n"),
+				}
+			},
+			cycle: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph := DependencyGraph{dependencies: buildDependencies(test.services(t), zap.NewNop())}
+			order, err := graph.TopologicalOrder()
+			if test.cycle {
+				if err == nil {
+					t.Fatalf("expected a cycle, got order %v", order)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(order, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, order)
+			}
+		})
+	}
+}
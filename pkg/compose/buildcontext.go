@@ -0,0 +1,154 @@
+package compose
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Maximum size of a build context before compression, in bytes. Zero
+// disables the limit
+var BuildContextSizeLimit int64 = 500 * 1024 * 1024
+
+// Read the patterns of the .dockerignore file of a build context, the same
+// way as the docker CLI. The Dockerfile and .dockerignore are always kept
+// since the daemon needs them
+func readDockerignore(contextDir string, dockerfile string) ([]string, error) {
+	excludes := []string{}
+	file, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return excludes, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		invert := strings.HasPrefix(pattern, "!")
+		if invert {
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		if len(pattern) > 0 {
+			pattern = filepath.Clean(pattern)
+			pattern = filepath.ToSlash(pattern)
+			if len(pattern) > 1 && pattern[0] == '/' {
+				pattern = pattern[1:]
+			}
+		}
+		if invert {
+			pattern = "!" + pattern
+		}
+		excludes = append(excludes, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read .dockerignore")
+	}
+
+	if keep, _ := fileutils.Matches(".dockerignore", excludes); keep {
+		excludes = append(excludes, "!.dockerignore")
+	}
+	if dockerfile != "" && !filepath.IsAbs(dockerfile) {
+		if keep, _ := fileutils.Matches(filepath.ToSlash(filepath.Clean(dockerfile)), excludes); keep {
+			excludes = append(excludes, "!"+dockerfile)
+		}
+	}
+	return excludes, nil
+}
+
+// Archive and compress a build context into a temporary file, honouring its
+// .dockerignore and BuildContextSizeLimit. The file is removed once the
+// returned reader is closed
+func archiveBuildContext(serviceName string, contextDir string, dockerfile string, archiveOpts *archive.TarOptions, logger *zap.Logger) (io.ReadCloser, error) {
+	excludes, err := readDockerignore(contextDir, dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	archiveOpts.ExcludePatterns = append(archiveOpts.ExcludePatterns, excludes...)
+
+	start := time.Now()
+	archiveCtx, err := archive.TarWithOptions(contextDir, archiveOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to archive build context")
+	}
+	tarSize := &countingReader{reader: archiveCtx, limit: BuildContextSizeLimit}
+	buildCtx, err := CompressBuiltCtx(ioutil.NopCloser(tarSize))
+	if err != nil {
+		archiveCtx.Close()
+		return nil, err
+	}
+	defer archiveCtx.Close()
+	defer buildCtx.Close()
+
+	file, err := ioutil.TempFile("", "ros-supervisor-context-")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create build context file")
+	}
+	compressedSize, err := io.Copy(file, buildCtx)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		if errors.Cause(err) == errContextTooLarge {
+			return nil, errors.Errorf("build context %s of service %s is larger than the limit of %s, exclude files with a .dockerignore or raise the limit",
+				contextDir, serviceName, units.BytesSize(float64(BuildContextSizeLimit)))
+		}
+		return nil, errors.Wrap(err, "unable to archive build context")
+	}
+
+	logger.Info(fmt.Sprintf("Build context of service %s is %s (%s compressed), archived in %s",
+		serviceName, units.BytesSize(float64(tarSize.count)), units.BytesSize(float64(compressedSize)), time.Since(start).Round(time.Millisecond)))
+	return &tempFileReader{File: file}, nil
+}
+
+var errContextTooLarge = errors.New("build context is too large")
+
+// countingReader counts the bytes read and fails once they exceed the limit
+type countingReader struct {
+	reader io.Reader
+	count  int64
+	limit  int64
+}
+
+func (r *countingReader) Read(content []byte) (int, error) {
+	read, err := r.reader.Read(content)
+	r.count += int64(read)
+	if r.limit > 0 && r.count > r.limit {
+		return read, errContextTooLarge
+	}
+	return read, err
+}
+
+// tempFileReader removes its file when closed
+type tempFileReader struct {
+	*os.File
+	once sync.Once
+}
+
+func (r *tempFileReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		err = r.File.Close()
+		os.Remove(r.File.Name())
+	})
+	return err
+}
@@ -0,0 +1,291 @@
+package compose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/pkg/errors"
+)
+
+// Directory holding the record and the full log of every build
+var BuildLogDir = "/supervisor/builds"
+
+// Number of builds whose log is kept per service
+var BuildLogHistoryLimit = 20
+
+// States of a build
+const (
+	BuildRunning   = "running"
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+)
+
+const buildLogPollInterval = 500 * time.Millisecond
+
+var ErrBuildNotFound = errors.New("build not found")
+
+// BuildRecord describes a build of a service. It is stored next to the log of
+// the build as <id>.json
+type BuildRecord struct {
+	ID         string     `json:"id"`
+	Project    string     `json:"project"`
+	Service    string     `json:"service"`
+	Commit     string     `json:"commit,omitempty"`
+	ImageID    string     `json:"image_id,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// buildLog writes the output of a running build to <id>.log and keeps its
+// record up to date
+type buildLog struct {
+	record BuildRecord
+	file   *os.File
+	mutex  sync.Mutex
+}
+
+// Create the record and the log file of a new build of a service, removing
+// the oldest builds of the service beyond BuildLogHistoryLimit
+func startBuildLog(projectName string, targetService *docker.Service) (*buildLog, error) {
+	if err := os.MkdirAll(BuildLogDir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "unable to create build log directory")
+	}
+	pruneBuildLogs(targetService.Name)
+
+	startedAt := time.Now().UTC()
+	log := &buildLog{
+		record: BuildRecord{
+			ID:        fmt.Sprintf("%s-%s", targetService.Name, startedAt.Format("20060102T150405.000000000")),
+			Project:   projectName,
+			Service:   targetService.Name,
+			Commit:    targetService.Commit,
+			Status:    BuildRunning,
+			StartedAt: startedAt,
+		},
+	}
+	file, err := os.Create(buildLogPath(log.record.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create build log")
+	}
+	log.file = file
+	if err := log.save(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+func (log *buildLog) Write(content []byte) (int, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.file.Write(content)
+}
+
+func (log *buildLog) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(log, format, args...)
+}
+
+// Record the outcome of the build and close its log
+func (log *buildLog) finish(imageID string, buildErr error) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.record.ImageID = imageID
+	log.record.Status = BuildSucceeded
+	if buildErr != nil {
+		log.record.Status = BuildFailed
+		log.record.Error = buildErr.Error()
+	}
+	finishedAt := time.Now().UTC()
+	log.record.FinishedAt = &finishedAt
+	log.file.Close()
+	return log.save()
+}
+
+// Mark the builds left running by a previous run of the supervisor as failed,
+// so that they can be pruned and their log is no longer followed
+func FailStaleBuilds() error {
+	records, err := ListBuilds("")
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.Status != BuildRunning {
+			continue
+		}
+		log := buildLog{record: record}
+		log.record.Status = BuildFailed
+		log.record.Error = "build was interrupted by a restart of the supervisor"
+		if err := log.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (log *buildLog) save() error {
+	content, err := json.Marshal(log.record)
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first so that readers never see a partial
+	// record
+	tmpPath := buildRecordPath(log.record.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return errors.Wrap(err, "unable to write build record")
+	}
+	return os.Rename(tmpPath, buildRecordPath(log.record.ID))
+}
+
+func buildRecordPath(id string) string {
+	return filepath.Join(BuildLogDir, id+".json")
+}
+
+func buildLogPath(id string) string {
+	return filepath.Join(BuildLogDir, id+".log")
+}
+
+// List the recorded builds, most recent first. Builds of every service are
+// listed if serviceName is empty
+func ListBuilds(serviceName string) ([]BuildRecord, error) {
+	entries, err := ioutil.ReadDir(BuildLogDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []BuildRecord{}, nil
+		}
+		return nil, err
+	}
+	records := []BuildRecord{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		record, err := GetBuild(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		if serviceName != "" && record.Service != serviceName {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+	return records, nil
+}
+
+// Read the record of a build
+func GetBuild(id string) (BuildRecord, error) {
+	record := BuildRecord{}
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return record, ErrBuildNotFound
+	}
+	content, err := ioutil.ReadFile(buildRecordPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return record, ErrBuildNotFound
+		}
+		return record, err
+	}
+	if err := json.Unmarshal(content, &record); err != nil {
+		return record, errors.Wrapf(err, "invalid record of build %s", id)
+	}
+	return record, nil
+}
+
+// Write the log of a build to w, only its last tail lines if tail is
+// positive. With follow, output is streamed until the build finishes or ctx
+// is done
+func WriteBuildLog(ctx context.Context, id string, tail int, follow bool, w io.Writer) error {
+	if _, err := GetBuild(id); err != nil {
+		return err
+	}
+	file, err := os.Open(buildLogPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrBuildNotFound
+		}
+		return err
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(tailLines(content, tail)); err != nil {
+		return err
+	}
+
+	for follow {
+		// The record is read before the log so that output written right
+		// before the build finished is not missed
+		record, err := GetBuild(id)
+		if err != nil {
+			return err
+		}
+		written, err := io.Copy(w, file)
+		if err != nil {
+			return err
+		}
+		if record.Status != BuildRunning {
+			return nil
+		}
+		if written > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(buildLogPollInterval):
+		}
+	}
+	return nil
+}
+
+func tailLines(content []byte, tail int) []byte {
+	if tail <= 0 {
+		return content
+	}
+	trimmed := bytes.TrimSuffix(content, []byte("\n"))
+	idx := len(trimmed)
+	for count := 0; count < tail; count++ {
+		idx = bytes.LastIndexByte(trimmed[:idx], '\n')
+		if idx < 0 {
+			return content
+		}
+	}
+	return content[idx+1:]
+}
+
+// Remove the oldest finished builds of a service so that a new one fits in
+// BuildLogHistoryLimit
+func pruneBuildLogs(serviceName string) {
+	if BuildLogHistoryLimit <= 0 {
+		return
+	}
+	records, err := ListBuilds(serviceName)
+	if err != nil || len(records) < BuildLogHistoryLimit {
+		return
+	}
+	for _, record := range records[BuildLogHistoryLimit-1:] {
+		if record.Status == BuildRunning {
+			continue
+		}
+		os.Remove(buildLogPath(record.ID))
+		os.Remove(buildRecordPath(record.ID))
+	}
+}
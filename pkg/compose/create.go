@@ -3,156 +3,248 @@ package compose
 import (
 	"context"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
 	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
 	moby "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-// Container stuff
-func CreateContainers(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) error {
+func CreateSingleContainer(ctx context.Context, projectName string, targetService *docker.Service, networks docker.Networks, dockerClient *client.Client, logger *zap.Logger) (string, error) {
 
-	err := CreateCoreContainer(ctx, dockerClient, project, logger)
+	containerName := targetService.ContainerName
+	if containerName == "" {
+		containerName = projectName + "_" + targetService.Name
+	}
+	// Only containers created by the supervisor for this service are removed.
+	// Any other container holding the name makes the creation fail
+	serviceContainers, err := dockerClient.ContainerList(ctx, moby.ContainerListOptions{
+		All:     true,
+		Filters: serviceFilter(projectName, targetService.Name),
+	})
 	if err != nil {
-		return err
+		logger.Error(fmt.Sprintf("Failed to list containers of service %s with error: %s", targetService.Name, err))
+		return "", err
 	}
-
-	logger.Info("Creating container for services")
-	for idx := range project.Services {
-		_, err := CreateSingleContainer(ctx, project.Name, &project.Services[idx], &project.Networks[0], dockerClient, logger)
+	for _, cont := range serviceContainers {
+		err := dockerClient.ContainerRemove(ctx, cont.ID, moby.ContainerRemoveOptions{})
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("Unable to create container for service %s with error: %s", project.Services[idx].Name, err))
-			return err
+			logger.Error(fmt.Sprintf("Failed to remove designated container with error: %s", err))
+			return "", err
 		}
 	}
-	return nil
-}
-
-func CreateCoreContainer(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) error {
-
-	err := CreateNetwork(ctx, project, dockerClient, true, logger)
+	if err := releaseContainerName(ctx, dockerClient, containerName, logger); err != nil {
+		return "", err
+	}
+	containerConfig, networkConfig, hostConfig := PrepareContainerCreateOptions(projectName, targetService, networks)
+	secretMounts, err := WriteServiceSecrets(projectName, targetService, logger)
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Unable to create network %s with error: %s", project.Networks[0].Name, err))
-		return err
+		logger.Error(fmt.Sprintf("Failed to prepare secrets of service %s with error: %s", targetService.Name, err))
+		return "", err
 	}
-
-	logger.Info("Creating container for core")
-	_, err = CreateSingleContainer(ctx, project.Name, &project.Core, &project.Networks[0], dockerClient, logger)
+	hostConfig.Mounts = append(hostConfig.Mounts, secretMounts...)
+	container, err := dockerClient.ContainerCreate(ctx, &containerConfig, &hostConfig, &networkConfig, nil, containerName)
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Unable to create container for core with error: %s", err))
-		return err
+		logger.Error(fmt.Sprintf("Failed to create container with error: %s", err))
+		return "", err
+	}
+	targetService.Container = docker.Container{
+		ID:   container.ID,
+		Name: containerName,
+	}
+	// A container that could not be fully configured is removed so that it
+	// does not hold the name of the next one
+	discard := func(err error) (string, error) {
+		RemoveServiceByID(ctx, dockerClient, container.ID, logger)
+		targetService.Container = docker.Container{}
+		return "", err
 	}
-	return nil
-}
 
-func CreateServiceContainers(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) error {
+	// The docker API only accepts a single network when creating a container,
+	// so the remaining networks are connected afterwards
+	if len(targetService.Networks) > 1 && targetService.NetworkMode == "" {
+		for _, serviceNetwork := range targetService.Networks[1:] {
+			endpointSettings := prepareEndpointSettings(targetService, &serviceNetwork, networks)
+			err := dockerClient.NetworkConnect(ctx, serviceNetwork.Name, container.ID, endpointSettings)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to connect container %s to network %s with error: %s", containerName, serviceNetwork.Name, err))
+				return discard(err)
+			}
+		}
+	}
 
-	err := CreateNetwork(ctx, project, dockerClient, false, logger)
+	err = CopyServiceFiles(ctx, dockerClient, targetService, logger)
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Unable to create network %s with error: %s", project.Networks[0].Name, err))
-		return err
+		return discard(err)
 	}
 
-	logger.Info("Creating container for services")
-	for idx := range project.Services {
-		_, err := CreateSingleContainer(ctx, project.Name, &project.Services[idx], &project.Networks[0], dockerClient, logger)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Unable to create container for service %s with error: %s", project.Services[idx].Name, err))
-			return err
-		}
-	}
-	return nil
+	return container.ID, nil
 }
 
-func CreateSingleContainer(ctx context.Context, projectName string, targetService *docker.Service, targetNetwork *docker.Network, dockerClient *client.Client, logger *zap.Logger) (string, error) {
-
-	containerName := projectName + "_" + targetService.Name
-	allContainers, err := dockerClient.ContainerList(ctx, moby.ContainerListOptions{
-		All: true,
-	})
+// Containers created by earlier versions of the supervisor carry no label.
+// Such a container holding the exact name of the service is removed once so
+// that the service can be recreated with its labels. A container created for
+// anything else is left alone and reported
+func releaseContainerName(ctx context.Context, dockerClient *client.Client, containerName string, logger *zap.Logger) error {
+	existing, err := dockerClient.ContainerInspect(ctx, containerName)
 	if err != nil {
-		logger.Error("Failed to list all containers")
-	}
-	for _, cont := range allContainers {
-		for _, name := range cont.Names {
-			if name == "/"+containerName {
-				err := dockerClient.ContainerRemove(ctx, cont.ID, moby.ContainerRemoveOptions{})
-				if err != nil {
-					logger.Error(fmt.Sprintf("Failed to remove designated container with error: %s", err))
-					return "", err
-				}
-			}
+		if client.IsErrNotFound(err) {
+			return nil
 		}
+		logger.Error(fmt.Sprintf("Failed to inspect container %s with error: %s", containerName, err))
+		return err
 	}
-	containerConfig, networkConfig, hostConfig := PrepareContainerCreateOptions(targetService, targetNetwork)
-	container, err := dockerClient.ContainerCreate(ctx, &containerConfig, &hostConfig, &networkConfig, nil, containerName)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to create container with error: %s", err))
-		return "", err
+	if strings.TrimPrefix(existing.Name, "/") != containerName {
+		return nil
 	}
-	targetService.Container = docker.Container{
-		ID:   container.ID,
-		Name: containerName,
+	if existing.Config != nil {
+		if project, ok := existing.Config.Labels[docker.LabelProject]; ok {
+			logger.Error(fmt.Sprintf("Container name %s is held by container %s of project %s service %s, which is not managed for this service",
+				containerName, existing.ID, project, existing.Config.Labels[docker.LabelService]))
+			return errors.Errorf("container name %s is already in use by container %s", containerName, existing.ID)
+		}
 	}
 
-	return container.ID, nil
+	logger.Warn(fmt.Sprintf("Removing unlabelled container %s (%s) left by a previous version of the supervisor", containerName, existing.ID))
+	err = dockerClient.ContainerRemove(ctx, existing.ID, moby.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to remove unlabelled container %s with error: %s", containerName, err))
+	}
+	return err
 }
 
-func PrepareContainerCreateOptions(targetService *docker.Service, targetNetwork *docker.Network) (container.Config, network.NetworkingConfig, container.HostConfig) {
-	containerConfig := PrepareContainerConfig(targetService)
-	networkConfig := PrepareNetworkConfig(targetService, targetNetwork)
+func PrepareContainerCreateOptions(projectName string, targetService *docker.Service, networks docker.Networks) (container.Config, network.NetworkingConfig, container.HostConfig) {
+	containerConfig := PrepareContainerConfig(projectName, targetService)
+	networkConfig := PrepareNetworkConfig(targetService, networks)
 	hostConfig := PrepareHostConfig(targetService)
 
 	return containerConfig, networkConfig, hostConfig
 }
 
-func PrepareContainerConfig(targetService *docker.Service) container.Config {
+func PrepareContainerConfig(projectName string, targetService *docker.Service) container.Config {
 
 	return container.Config{
-		Hostname:   targetService.Hostname,
-		Domainname: targetService.Domainname,
-		User:       targetService.User,
-		Tty:        targetService.Tty,
-		Cmd:        strslice.StrSlice(targetService.Command),
-		Entrypoint: strslice.StrSlice(targetService.EntryPoint),
-		Image:      targetService.Image.Name,
-		WorkingDir: targetService.WorkingDir,
-		StopSignal: "SIGTERM",
-		Env:        targetService.Environment,
+		Hostname:     targetService.Hostname,
+		Domainname:   targetService.Domainname,
+		User:         targetService.User,
+		Tty:          targetService.Tty,
+		OpenStdin:    targetService.StdinOpen,
+		Cmd:          strslice.StrSlice(targetService.Command),
+		Entrypoint:   strslice.StrSlice(targetService.EntryPoint),
+		Image:        targetService.Image.Reference(),
+		WorkingDir:   targetService.WorkingDir,
+		StopSignal:   targetService.StopSignal,
+		StopTimeout:  getStopTimeout(targetService),
+		Env:          targetService.Environment,
+		ExposedPorts: getExposedPorts(targetService),
+		Healthcheck:  getHealthCheck(targetService),
+		Labels:       serviceLabels(projectName, targetService),
 	}
 }
 
-func PrepareNetworkConfig(targetService *docker.Service, targetNetwork *docker.Network) network.NetworkingConfig {
-	// Inspect network first to get the ID
+// Grace period in seconds given to the container to stop, which the daemon
+// uses when stopping it outside of the supervisor as well
+func getStopTimeout(targetService *docker.Service) *int {
+	if targetService.StopGracePeriod == nil {
+		return nil
+	}
+	timeout := int(targetService.StopGracePeriod.Seconds())
+	return &timeout
+}
 
-	// Get aliases
-	aliases := []string{targetService.Name}
+func getLogConfig(targetService *docker.Service) container.LogConfig {
+	logConfig := container.LogConfig{
+		Type:   "json-file",
+		Config: targetService.Logging.Options,
+	}
+	if targetService.Logging.Driver != "" {
+		logConfig.Type = targetService.Logging.Driver
+	}
+	return logConfig
+}
 
-	endPointConfig := map[string]*network.EndpointSettings{
-		targetNetwork.Name: {
-			NetworkID: targetNetwork.ID,
-			IPAddress: targetService.Networks[0].IPv4,
-			Aliases:   aliases,
-			IPAMConfig: &network.EndpointIPAMConfig{
-				IPv4Address: targetService.Networks[0].IPv4,
-			},
-		},
+func getHealthCheck(targetService *docker.Service) *container.HealthConfig {
+	if targetService.HealthCheck == nil {
+		return nil
+	}
+	if targetService.HealthCheck.Disable {
+		return &container.HealthConfig{
+			Test: []string{"NONE"},
+		}
+	}
+	return &container.HealthConfig{
+		Test:        targetService.HealthCheck.Test,
+		Interval:    targetService.HealthCheck.Interval,
+		Timeout:     targetService.HealthCheck.Timeout,
+		StartPeriod: targetService.HealthCheck.StartPeriod,
+		Retries:     targetService.HealthCheck.Retries,
+	}
+}
+
+// Prepare the endpoint of the first network of the service. Other networks
+// are connected once the container is created
+func PrepareNetworkConfig(targetService *docker.Service, networks docker.Networks) network.NetworkingConfig {
+	endPointConfig := map[string]*network.EndpointSettings{}
+	// Containers sharing the network of the host or of another container
+	// cannot be attached to networks
+	if targetService.NetworkMode != "" {
+		return network.NetworkingConfig{
+			EndpointsConfig: endPointConfig,
+		}
+	}
+	if len(targetService.Networks) > 0 {
+		serviceNetwork := targetService.Networks[0]
+		endPointConfig[serviceNetwork.Name] = prepareEndpointSettings(targetService, &serviceNetwork, networks)
 	}
 	return network.NetworkingConfig{
 		EndpointsConfig: endPointConfig,
 	}
 }
 
+func prepareEndpointSettings(targetService *docker.Service, serviceNetwork *docker.ServiceNetwork, networks docker.Networks) *network.EndpointSettings {
+	// Get aliases
+	aliases := []string{targetService.Name}
+	aliases = append(aliases, serviceNetwork.Aliases...)
+
+	endpointSettings := &network.EndpointSettings{
+		Aliases: aliases,
+	}
+	for _, projectNetwork := range networks {
+		if projectNetwork.NetworkName == serviceNetwork.Name {
+			endpointSettings.NetworkID = projectNetwork.ID
+		}
+	}
+	// Without a fixed address the container gets one assigned from the pool
+	// of the network
+	if serviceNetwork.IPv4 != "" || serviceNetwork.IPv6 != "" {
+		endpointSettings.IPAddress = serviceNetwork.IPv4
+		endpointSettings.GlobalIPv6Address = serviceNetwork.IPv6
+		endpointSettings.IPAMConfig = &network.EndpointIPAMConfig{
+			IPv4Address: serviceNetwork.IPv4,
+			IPv6Address: serviceNetwork.IPv6,
+		}
+	}
+	return endpointSettings
+}
+
 func prepareVolumeBinding(targetService *docker.Service) []string {
 	output := []string{}
 	for _, volume := range targetService.Volumes {
+		if volume.Type != docker.VolumeTypeBind {
+			continue
+		}
 		if len(volume.Source) > 0 && len(volume.Destination) > 0 {
 			bindMount := volume.Source + ":" + volume.Destination
 
@@ -166,6 +258,48 @@ func prepareVolumeBinding(targetService *docker.Service) []string {
 	return output
 }
 
+func prepareMounts(targetService *docker.Service) []mount.Mount {
+	output := []mount.Mount{}
+	for _, volume := range targetService.Volumes {
+		switch volume.Type {
+		case docker.VolumeTypeVolume:
+			output = append(output, mount.Mount{
+				Type:     mount.TypeVolume,
+				Source:   volume.Source,
+				Target:   volume.Destination,
+				ReadOnly: volume.ReadOnly,
+				VolumeOptions: &mount.VolumeOptions{
+					NoCopy: volume.NoCopy,
+				},
+			})
+		case docker.VolumeTypeTmpfs:
+			output = append(output, mount.Mount{
+				Type:     mount.TypeTmpfs,
+				Target:   volume.Destination,
+				ReadOnly: volume.ReadOnly,
+				TmpfsOptions: &mount.TmpfsOptions{
+					SizeBytes: volume.TmpfsSize,
+					Mode:      os.FileMode(volume.TmpfsMode),
+				},
+			})
+		}
+	}
+	return output
+}
+
+func prepareTmpfs(targetService *docker.Service) map[string]string {
+	output := map[string]string{}
+	for _, tmpfs := range targetService.Tmpfs {
+		split := strings.SplitN(tmpfs, ":", 2)
+		if len(split) > 1 {
+			output[split[0]] = split[1]
+		} else {
+			output[split[0]] = ""
+		}
+	}
+	return output
+}
+
 func getRestartPolicy(targetService *docker.Service) container.RestartPolicy {
 	var restart container.RestartPolicy
 	if targetService.Restart != "" {
@@ -196,6 +330,23 @@ func getPortBinding(targetService *docker.Service) nat.PortMap {
 	return bindingMap
 }
 
+func getExposedPorts(targetService *docker.Service) nat.PortSet {
+	exposedPorts := nat.PortSet{}
+	for _, port := range targetService.Ports {
+		exposedPorts[nat.Port(port.Target+"/"+port.Protocol)] = struct{}{}
+	}
+	for _, expose := range targetService.Expose {
+		mappings, err := nat.ParsePortSpec(expose)
+		if err != nil {
+			continue
+		}
+		for _, mapping := range mappings {
+			exposedPorts[mapping.Port] = struct{}{}
+		}
+	}
+	return exposedPorts
+}
+
 func getResouces(targetService *docker.Service) container.Resources {
 	deviceMappingList := []container.DeviceMapping{}
 	for _, device := range targetService.Devices {
@@ -203,24 +354,60 @@ func getResouces(targetService *docker.Service) container.Resources {
 		deviceMapping := container.DeviceMapping{
 			CgroupPermissions: "rwm",
 		}
+		deviceMapping.PathOnHost = deviceSplit[0]
+		deviceMapping.PathInContainer = deviceSplit[0]
 		switch len(deviceSplit) {
 		case 3:
 			deviceMapping.CgroupPermissions = deviceSplit[2]
 			fallthrough
 		case 2:
 			deviceMapping.PathInContainer = deviceSplit[1]
-			fallthrough
-		case 1:
-			deviceMapping.PathInContainer = deviceSplit[0]
 		}
 		deviceMappingList = append(deviceMappingList, deviceMapping)
 	}
 
+	ulimits := []*units.Ulimit{}
+	for _, ulimit := range targetService.Ulimits {
+		ulimits = append(ulimits, &units.Ulimit{
+			Name: ulimit.Name,
+			Soft: ulimit.Soft,
+			Hard: ulimit.Hard,
+		})
+	}
+
+	deviceRequests := []container.DeviceRequest{}
+	for _, request := range targetService.DeviceRequests {
+		deviceRequest := container.DeviceRequest{
+			Driver:    request.Driver,
+			Count:     request.Count,
+			DeviceIDs: request.DeviceIDs,
+			Options:   request.Options,
+		}
+		if len(request.Capabilities) > 0 {
+			deviceRequest.Capabilities = [][]string{request.Capabilities}
+		}
+		deviceRequests = append(deviceRequests, deviceRequest)
+	}
+
 	resources := container.Resources{
-		CgroupParent:   targetService.CgroupParent,
-		Memory:         targetService.MemLimit,
-		OomKillDisable: &targetService.OomKillDisable,
-		Devices:        deviceMappingList,
+		CgroupParent:       targetService.CgroupParent,
+		Memory:             targetService.MemLimit,
+		MemorySwap:         targetService.MemSwapLimit,
+		MemoryReservation:  targetService.MemReservation,
+		NanoCPUs:           int64(targetService.CPUs * 1e9),
+		CpusetCpus:         targetService.CPUSet,
+		CPUShares:          targetService.CPUShares,
+		CPUQuota:           targetService.CPUQuota,
+		CPUPeriod:          targetService.CPUPeriod,
+		CPURealtimeRuntime: targetService.CPURTRuntime,
+		CPURealtimePeriod:  targetService.CPURTPeriod,
+		OomKillDisable:     &targetService.OomKillDisable,
+		Devices:            deviceMappingList,
+		DeviceRequests:     deviceRequests,
+		Ulimits:            ulimits,
+	}
+	if targetService.PidsLimit != 0 {
+		resources.PidsLimit = &targetService.PidsLimit
 	}
 
 	return resources
@@ -231,18 +418,20 @@ func PrepareHostConfig(targetService *docker.Service) container.HostConfig {
 	return container.HostConfig{
 		AutoRemove:    false,
 		Binds:         prepareVolumeBinding(targetService),
+		Mounts:        prepareMounts(targetService),
+		Tmpfs:         prepareTmpfs(targetService),
 		CapAdd:        targetService.CapAdd,
 		CapDrop:       targetService.CapDrop,
 		NetworkMode:   container.NetworkMode(targetService.NetworkMode),
 		RestartPolicy: getRestartPolicy(targetService),
-		LogConfig: container.LogConfig{
-			Type: "json-file",
-		},
-		IpcMode:      container.IpcMode(targetService.IpcMode),
-		PortBindings: getPortBinding(targetService),
-		Resources:    getResouces(targetService),
-		Sysctls:      targetService.Sysctls,
-		Privileged:   targetService.Privileged,
+		LogConfig:     getLogConfig(targetService),
+		Init:          targetService.Init,
+		IpcMode:       container.IpcMode(targetService.IpcMode),
+		PortBindings:  getPortBinding(targetService),
+		Resources:     getResouces(targetService),
+		Sysctls:       targetService.Sysctls,
+		Privileged:    targetService.Privileged,
+		ShmSize:       targetService.ShmSize,
 	}
 }
 
@@ -259,58 +448,230 @@ func PrepareNetworkOptions(projectName string, targetNetwork *docker.Network) mo
 	}
 }
 
-func CreateNetwork(ctx context.Context, project *Project, dockerClient *client.Client, forceRecreate bool, logger *zap.Logger) error {
-	for idx, network := range project.Networks {
-		networkOpts := PrepareNetworkOptions(project.Name, &network)
-		networkName := network.Name
+// Create the networks of the project that do not exist yet. Existing
+// networks are only recreated when their driver or IPAM configuration differ
+// from the project, in which case the attached containers are reconnected.
+// External networks must exist already and are left untouched
+func CreateNetwork(ctx context.Context, project *Project, dockerClient *client.Client, logger *zap.Logger) error {
+	for idx := range project.Networks {
+		targetNetwork := project.Networks[idx]
+		networkName := targetNetwork.NetworkName
 		info, err := dockerClient.NetworkInspect(ctx, networkName, moby.NetworkInspectOptions{})
+		if err != nil && !errdefs.IsNotFound(err) {
+			logger.Error(fmt.Sprintf("Unable to inspect network %s with error: %v", networkName, err))
+			return err
+		}
+
+		if targetNetwork.External {
+			if err != nil {
+				logger.Error(fmt.Sprintf("External network %s does not exist", networkName))
+				return err
+			}
+			project.Networks[idx].ID = info.ID
+			continue
+		}
+
 		// Only create network if it does not exist
 		if err != nil {
-			resp, err := dockerClient.NetworkCreate(ctx, networkName, networkOpts)
+			logger.Info(fmt.Sprintf("Creating network %s", networkName))
+			resp, err := dockerClient.NetworkCreate(ctx, networkName, PrepareNetworkOptions(project.Name, &targetNetwork))
 			if err != nil {
-				// Error means there could be a network existed already
 				logger.Error(fmt.Sprintf("Unable to create network %s with error: %v", networkName, err))
 				return err
 			}
-			network.ID = resp.ID
-		} else {
-			if forceRecreate {
-				// Delete old network setup and recreate them
-				// Note that all containers that use the target network must be killed
-				err := dockerClient.NetworkRemove(ctx, info.ID)
-				if err != nil {
-					logger.Error(fmt.Sprintf("Unable to remove network %s with error: %v", networkName, err))
-					return err
-				}
-				logger.Info(fmt.Sprintf("Recreating network %s", networkName))
-				resp, err := dockerClient.NetworkCreate(ctx, networkName, networkOpts)
-				if err != nil {
-					logger.Error(fmt.Sprintf("Unable to create network %s with error: %v", networkName, err))
-					return err
-				}
-				project.Networks[idx].ID = resp.ID
-			} else {
-				// Maybe extract existing values
-				networkRes, err := dockerClient.NetworkList(ctx, moby.NetworkListOptions{})
-				if err != nil {
-					logger.Error(fmt.Sprintf("Unable to list network %s with error: %v", networkName, err))
-					return err
-				}
-
-				for _, net := range networkRes {
-					if net.Name == networkName {
-						logger.Info("Extracting Network Info")
-						project.Networks[idx].ID = net.ID
-						return nil
-					}
-				}
-			}
+			project.Networks[idx].ID = resp.ID
+			continue
+		}
+
+		if networkMatches(&targetNetwork, info) {
+			project.Networks[idx].ID = info.ID
+			continue
 		}
+		logger.Info(fmt.Sprintf("Configuration of network %s has changed. Recreating network", networkName))
+		networkID, err := recreateNetwork(ctx, project, &targetNetwork, info, dockerClient, logger)
+		if err != nil {
+			return err
+		}
+		project.Networks[idx].ID = networkID
 	}
 	return nil
 }
 
+// Compare the driver and IPAM configuration of an existing network with the
+// project. Options left empty in the project are assigned by docker and match
+// any value
+func networkMatches(targetNetwork *docker.Network, info moby.NetworkResource) bool {
+	if targetNetwork.Driver != "" && targetNetwork.Driver != info.Driver {
+		return false
+	}
+	if targetNetwork.Ipam.Driver != "" && targetNetwork.Ipam.Driver != info.IPAM.Driver {
+		return false
+	}
+	if len(targetNetwork.Ipam.Config) == 0 {
+		return true
+	}
+	if len(targetNetwork.Ipam.Config) != len(info.IPAM.Config) {
+		return false
+	}
+	for _, desired := range targetNetwork.Ipam.Config {
+		found := false
+		for _, existing := range info.IPAM.Config {
+			if desired.Subnet == existing.Subnet &&
+				(desired.Gateway == "" || desired.Gateway == existing.Gateway) &&
+				(desired.IPRange == "" || desired.IPRange == existing.IPRange) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Disconnect every container from the network, recreate it and connect the
+// containers again. Containers of the project get the endpoint of their
+// service, others keep their aliases
+func recreateNetwork(ctx context.Context, project *Project, targetNetwork *docker.Network, info moby.NetworkResource, dockerClient *client.Client, logger *zap.Logger) (string, error) {
+	networkName := targetNetwork.NetworkName
+	endpoints := map[string]*network.EndpointSettings{}
+	// Containers are put back on the network as they were if it cannot be
+	// recreated
+	disconnected := map[string]*network.EndpointSettings{}
+	restore := func(networkID string) {
+		for containerID, endpoint := range disconnected {
+			endpoint.NetworkID = networkID
+			if err := dockerClient.NetworkConnect(ctx, networkID, containerID, endpoint); err != nil {
+				logger.Error(fmt.Sprintf("Unable to reconnect container %s to network %s with error: %v", containerID, networkName, err))
+			}
+		}
+	}
+
+	for containerID, endpoint := range info.Containers {
+		endpoints[containerID] = reconnectEndpoint(ctx, project, targetNetwork, containerID, endpoint, dockerClient)
+		current := currentEndpoint(ctx, containerID, networkName, dockerClient)
+		err := dockerClient.NetworkDisconnect(ctx, info.ID, containerID, true)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to disconnect container %s from network %s with error: %v", endpoint.Name, networkName, err))
+			restore(info.ID)
+			return "", err
+		}
+		disconnected[containerID] = current
+	}
+
+	err := dockerClient.NetworkRemove(ctx, info.ID)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to remove network %s with error: %v", networkName, err))
+		restore(info.ID)
+		return "", err
+	}
+	resp, err := dockerClient.NetworkCreate(ctx, networkName, PrepareNetworkOptions(project.Name, targetNetwork))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to create network %s with error: %v", networkName, err))
+		previous, restoreErr := dockerClient.NetworkCreate(ctx, networkName, previousNetworkOptions(info))
+		if restoreErr != nil {
+			logger.Error(fmt.Sprintf("Unable to restore network %s with error: %v", networkName, restoreErr))
+			return "", err
+		}
+		restore(previous.ID)
+		return "", err
+	}
+
+	for containerID, endpoint := range endpoints {
+		endpoint.NetworkID = resp.ID
+		err := dockerClient.NetworkConnect(ctx, resp.ID, containerID, endpoint)
+		if err != nil {
+			// The network exists again, so a container that cannot be
+			// reconnected does not prevent the others from being
+			logger.Error(fmt.Sprintf("Unable to reconnect container %s to network %s with error: %v", containerID, networkName, err))
+		}
+	}
+	return resp.ID, nil
+}
+
+// Endpoint settings a container is connected to a network with
+func currentEndpoint(ctx context.Context, containerID string, networkName string, dockerClient *client.Client) *network.EndpointSettings {
+	endpointSettings := &network.EndpointSettings{}
+	info, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err == nil && info.NetworkSettings != nil {
+		if existing, ok := info.NetworkSettings.Networks[networkName]; ok {
+			endpointSettings.IPAMConfig = existing.IPAMConfig
+			endpointSettings.Aliases = existing.Aliases
+			endpointSettings.Links = existing.Links
+		}
+	}
+	return endpointSettings
+}
+
+// Options recreating a network as it was
+func previousNetworkOptions(info moby.NetworkResource) moby.NetworkCreate {
+	ipam := info.IPAM
+	return moby.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         info.Driver,
+		EnableIPv6:     info.EnableIPv6,
+		IPAM:           &ipam,
+		Internal:       info.Internal,
+		Attachable:     info.Attachable,
+		Options:        info.Options,
+		Labels:         info.Labels,
+	}
+}
+
+func reconnectEndpoint(ctx context.Context, project *Project, targetNetwork *docker.Network, containerID string, endpoint moby.EndpointResource, dockerClient *client.Client) *network.EndpointSettings {
+	services := append(docker.Services{project.Core}, project.Services...)
+	for idx := range services {
+		if services[idx].ContainerName != endpoint.Name && services[idx].Container.ID != containerID {
+			continue
+		}
+		for _, serviceNetwork := range services[idx].Networks {
+			if serviceNetwork.Name == targetNetwork.NetworkName {
+				return prepareEndpointSettings(&services[idx], &serviceNetwork, docker.Networks{})
+			}
+		}
+	}
+
+	// Addresses of other containers may not fit the new subnets
+	endpointSettings := currentEndpoint(ctx, containerID, targetNetwork.NetworkName, dockerClient)
+	endpointSettings.IPAMConfig = nil
+	return endpointSettings
+}
+
 // Volume stuff
-func CreateVolume(ctx context.Context) {
+func PrepareVolumeOptions(targetVolume *docker.Volume) volume.VolumeCreateBody {
+	return volume.VolumeCreateBody{
+		Name:       targetVolume.VolumeName,
+		Driver:     targetVolume.Driver,
+		DriverOpts: targetVolume.DriverOpts,
+		Labels:     targetVolume.Labels,
+	}
+}
 
+func CreateVolume(ctx context.Context, project *Project, dockerClient *client.Client, logger *zap.Logger) error {
+	for _, targetVolume := range project.Volumes {
+		volumeName := targetVolume.VolumeName
+		// Only create volume if it does not exist, as removing it would lose
+		// its data
+		_, err := dockerClient.VolumeInspect(ctx, volumeName)
+		if err == nil {
+			logger.Info(fmt.Sprintf("Volume %s exists already", volumeName))
+			continue
+		}
+		if !errdefs.IsNotFound(err) {
+			logger.Error(fmt.Sprintf("Unable to inspect volume %s with error: %v", volumeName, err))
+			return err
+		}
+		if targetVolume.External {
+			logger.Error(fmt.Sprintf("External volume %s does not exist", volumeName))
+			return err
+		}
+		logger.Info(fmt.Sprintf("Creating volume %s", volumeName))
+		_, err = dockerClient.VolumeCreate(ctx, PrepareVolumeOptions(&targetVolume))
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to create volume %s with error: %v", volumeName, err))
+			return err
+		}
+	}
+	return nil
 }
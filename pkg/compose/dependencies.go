@@ -0,0 +1,215 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Maximum time to wait for the condition of a dependency to be met
+var DependencyWaitTimeout = 5 * time.Minute
+
+const dependencyPollInterval = time.Second
+
+// DependencyGraph maps every service to the services it depends on
+type DependencyGraph struct {
+	dependencies map[string][]string
+}
+
+// Build the dependency graph of the services of a project. Dependencies on
+// core are satisfied by starting core first and are left out of the graph
+func NewDependencyGraph(project *Project) (*DependencyGraph, error) {
+	graph := DependencyGraph{
+		dependencies: map[string][]string{},
+	}
+	for _, service := range project.Services {
+		graph.dependencies[service.Name] = []string{}
+	}
+	for _, service := range project.Services {
+		for _, dependency := range service.DependsOn {
+			switch dependency.Condition {
+			case docker.ConditionServiceStarted, docker.ConditionServiceHealthy, docker.ConditionServiceCompletedSuccessfully:
+			default:
+				return nil, errors.Errorf("service %s depends on %s with unsupported condition %s", service.Name, dependency.Name, dependency.Condition)
+			}
+			if dependency.Name == project.Core.Name && project.Core.Name != "" {
+				continue
+			}
+			if _, ok := graph.dependencies[dependency.Name]; !ok {
+				return nil, errors.Errorf("service %s depends on undefined service %s", service.Name, dependency.Name)
+			}
+			graph.dependencies[service.Name] = append(graph.dependencies[service.Name], dependency.Name)
+		}
+	}
+	return &graph, nil
+}
+
+// Order services so that each of them comes after its dependencies. Services
+// that become ready at the same time are sorted by name to keep the order
+// stable
+func (graph *DependencyGraph) TopologicalOrder() ([]string, error) {
+	remaining := map[string]int{}
+	dependents := map[string][]string{}
+	for name, dependencies := range graph.dependencies {
+		remaining[name] = len(dependencies)
+		for _, dependency := range dependencies {
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+
+	ready := []string{}
+	for name, count := range remaining {
+		if count == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	order := []string{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) != len(graph.dependencies) {
+		return nil, errors.Errorf("dependency cycle between services: %s", strings.Join(graph.findCycle(), " -> "))
+	}
+	return order, nil
+}
+
+// Find a cycle in the graph using a depth first search, and return the names
+// of the services along the cycle
+func (graph *DependencyGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	stack := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+		dependencies := append([]string{}, graph.dependencies[name]...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			switch state[dependency] {
+			case visiting:
+				for idx, entry := range stack {
+					if entry == dependency {
+						return append(append([]string{}, stack[idx:]...), dependency)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dependency); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	names := []string{}
+	for name := range graph.dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if state[name] == unvisited {
+			if cycle := visit(name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// Wait until the condition of every dependency of a service is met
+func WaitForDependencies(ctx context.Context, dockerClient *client.Client, project *Project, targetService *docker.Service, logger *zap.Logger) error {
+	for _, dependency := range targetService.DependsOn {
+		dependencyService := project.GetService(dependency.Name)
+		if dependency.Name == project.Core.Name {
+			dependencyService = project.Core
+		}
+		logger.Info(fmt.Sprintf("Service %s is waiting for %s to satisfy %s", targetService.Name, dependency.Name, dependency.Condition))
+		err := waitForCondition(ctx, dockerClient, &dependencyService, dependency.Condition, logger)
+		if err != nil {
+			return errors.Wrapf(err, "dependency %s of service %s", dependency.Name, targetService.Name)
+		}
+	}
+	return nil
+}
+
+func waitForCondition(ctx context.Context, dockerClient *client.Client, targetService *docker.Service, condition string, logger *zap.Logger) error {
+	waitCtx, cancel := context.WithTimeout(ctx, DependencyWaitTimeout)
+	defer cancel()
+
+	if targetService.Container.ID == "" {
+		return errors.New("container has not been created")
+	}
+
+	if condition == docker.ConditionServiceCompletedSuccessfully {
+		resultC, errC := dockerClient.ContainerWait(waitCtx, targetService.Container.ID, container.WaitConditionNotRunning)
+		select {
+		case result := <-resultC:
+			if result.StatusCode != 0 {
+				return errors.Errorf("container exited with code %d", result.StatusCode)
+			}
+			return nil
+		case err := <-errC:
+			return err
+		}
+	}
+
+	for {
+		state, err := InspectServiceState(waitCtx, targetService, dockerClient, logger)
+		if err != nil {
+			return err
+		}
+		switch condition {
+		case docker.ConditionServiceStarted:
+			if state.Status == "running" {
+				return nil
+			}
+		case docker.ConditionServiceHealthy:
+			if state.Health == types.Healthy {
+				return nil
+			}
+			if state.Health == types.Unhealthy {
+				return errors.New("container is unhealthy")
+			}
+			if state.Health == types.NoHealthcheck {
+				return errors.New("container has no healthcheck")
+			}
+		}
+		if state.Status == "exited" || state.Status == "dead" {
+			return errors.Errorf("container is %s", state.Status)
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return errors.Errorf("timed out waiting for %s", condition)
+		case <-time.After(dependencyPollInterval):
+		}
+	}
+}
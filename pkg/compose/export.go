@@ -0,0 +1,657 @@
+package compose
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"gopkg.in/yaml.v3"
+)
+
+type composeFile struct {
+	Name     string                       `yaml:"name,omitempty"`
+	Services map[string]composeService    `yaml:"services"`
+	Networks map[string]composeNetwork    `yaml:"networks,omitempty"`
+	Volumes  map[string]composeVolume     `yaml:"volumes,omitempty"`
+	Configs  map[string]composeFileObject `yaml:"configs,omitempty"`
+	Secrets  map[string]composeFileObject `yaml:"secrets,omitempty"`
+}
+
+type composeService struct {
+	Image           string                            `yaml:"image,omitempty"`
+	Build           *composeBuild                     `yaml:"build,omitempty"`
+	PullPolicy      string                            `yaml:"pull_policy,omitempty"`
+	ContainerName   string                            `yaml:"container_name,omitempty"`
+	Hostname        string                            `yaml:"hostname,omitempty"`
+	Domainname      string                            `yaml:"domainname,omitempty"`
+	User            string                            `yaml:"user,omitempty"`
+	WorkingDir      string                            `yaml:"working_dir,omitempty"`
+	EntryPoint      interface{}                       `yaml:"entrypoint,omitempty"`
+	Command         interface{}                       `yaml:"command,omitempty"`
+	Environment     []string                          `yaml:"environment,omitempty"`
+	DependsOn       map[string]composeDependency      `yaml:"depends_on,omitempty"`
+	Restart         string                            `yaml:"restart,omitempty"`
+	Init            *bool                             `yaml:"init,omitempty"`
+	StopSignal      string                            `yaml:"stop_signal,omitempty"`
+	StopGracePeriod string                            `yaml:"stop_grace_period,omitempty"`
+	Logging         *composeLogging                   `yaml:"logging,omitempty"`
+	Tty             bool                              `yaml:"tty,omitempty"`
+	StdinOpen       bool                              `yaml:"stdin_open,omitempty"`
+	Privileged      bool                              `yaml:"privileged,omitempty"`
+	CapAdd          []string                          `yaml:"cap_add,omitempty"`
+	CapDrop         []string                          `yaml:"cap_drop,omitempty"`
+	Devices         []string                          `yaml:"devices,omitempty"`
+	NetworkMode     string                            `yaml:"network_mode,omitempty"`
+	Ipc             string                            `yaml:"ipc,omitempty"`
+	Sysctls         map[string]string                 `yaml:"sysctls,omitempty"`
+	CgroupParent    string                            `yaml:"cgroup_parent,omitempty"`
+	CPUs            float64                           `yaml:"cpus,omitempty"`
+	CPUSet          string                            `yaml:"cpuset,omitempty"`
+	CPUShares       int64                             `yaml:"cpu_shares,omitempty"`
+	CPUQuota        int64                             `yaml:"cpu_quota,omitempty"`
+	CPUPeriod       int64                             `yaml:"cpu_period,omitempty"`
+	CPURTRuntime    int64                             `yaml:"cpu_rt_runtime,omitempty"`
+	CPURTPeriod     int64                             `yaml:"cpu_rt_period,omitempty"`
+	MemLimit        int64                             `yaml:"mem_limit,omitempty"`
+	MemSwapLimit    int64                             `yaml:"memswap_limit,omitempty"`
+	MemReservation  int64                             `yaml:"mem_reservation,omitempty"`
+	OomKillDisable  bool                              `yaml:"oom_kill_disable,omitempty"`
+	PidsLimit       int64                             `yaml:"pids_limit,omitempty"`
+	ShmSize         int64                             `yaml:"shm_size,omitempty"`
+	Ulimits         map[string]composeUlimit          `yaml:"ulimits,omitempty"`
+	Deploy          *composeDeploy                    `yaml:"deploy,omitempty"`
+	HealthCheck     *composeHealthCheck               `yaml:"healthcheck,omitempty"`
+	Networks        map[string]*composeServiceNetwork `yaml:"networks,omitempty"`
+	Ports           []composePort                     `yaml:"ports,omitempty"`
+	Expose          []string                          `yaml:"expose,omitempty"`
+	Volumes         []interface{}                     `yaml:"volumes,omitempty"`
+	Tmpfs           []string                          `yaml:"tmpfs,omitempty"`
+	Configs         []composeFileReference            `yaml:"configs,omitempty"`
+	Secrets         []composeFileReference            `yaml:"secrets,omitempty"`
+}
+
+type composeLogging struct {
+	Driver  string            `yaml:"driver,omitempty"`
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+type composeBuild struct {
+	Context    string             `yaml:"context"`
+	Dockerfile string             `yaml:"dockerfile,omitempty"`
+	Args       map[string]*string `yaml:"args,omitempty"`
+	Target     string             `yaml:"target,omitempty"`
+	Labels     map[string]string  `yaml:"labels,omitempty"`
+	CacheFrom  []string           `yaml:"cache_from,omitempty"`
+	ShmSize    int64              `yaml:"shm_size,omitempty"`
+	Network    string             `yaml:"network,omitempty"`
+	ExtraHosts []string           `yaml:"extra_hosts,omitempty"`
+}
+
+type composeDependency struct {
+	Condition string `yaml:"condition"`
+}
+
+type composeUlimit struct {
+	Soft int64 `yaml:"soft"`
+	Hard int64 `yaml:"hard"`
+}
+
+type composeDeploy struct {
+	Resources composeResources `yaml:"resources"`
+}
+
+type composeResources struct {
+	Reservations composeReservations `yaml:"reservations"`
+}
+
+type composeReservations struct {
+	Devices []composeDeviceRequest `yaml:"devices"`
+}
+
+type composeDeviceRequest struct {
+	Driver       string            `yaml:"driver,omitempty"`
+	Count        interface{}       `yaml:"count,omitempty"`
+	DeviceIDs    []string          `yaml:"device_ids,omitempty"`
+	Capabilities []string          `yaml:"capabilities,omitempty"`
+	Options      map[string]string `yaml:"options,omitempty"`
+}
+
+type composeHealthCheck struct {
+	Test        []string `yaml:"test,omitempty"`
+	Interval    string   `yaml:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+	StartPeriod string   `yaml:"start_period,omitempty"`
+	Retries     int      `yaml:"retries,omitempty"`
+	Disable     bool     `yaml:"disable,omitempty"`
+}
+
+type composeServiceNetwork struct {
+	Aliases []string `yaml:"aliases,omitempty"`
+	IPv4    string   `yaml:"ipv4_address,omitempty"`
+	IPv6    string   `yaml:"ipv6_address,omitempty"`
+}
+
+type composePort struct {
+	Target    int    `yaml:"target"`
+	Published string `yaml:"published,omitempty"`
+	HostIp    string `yaml:"host_ip,omitempty"`
+	Protocol  string `yaml:"protocol,omitempty"`
+}
+
+type composeVolumeMount struct {
+	Type     string                     `yaml:"type"`
+	Source   string                     `yaml:"source,omitempty"`
+	Target   string                     `yaml:"target"`
+	ReadOnly bool                       `yaml:"read_only,omitempty"`
+	Bind     *composeBindOptions        `yaml:"bind,omitempty"`
+	Volume   *composeVolumeMountOptions `yaml:"volume,omitempty"`
+	Tmpfs    *composeTmpfsOptions       `yaml:"tmpfs,omitempty"`
+}
+
+type composeBindOptions struct {
+	Propagation string `yaml:"propagation"`
+}
+
+type composeVolumeMountOptions struct {
+	NoCopy bool `yaml:"nocopy"`
+}
+
+type composeTmpfsOptions struct {
+	Size int64  `yaml:"size,omitempty"`
+	Mode uint32 `yaml:"mode,omitempty"`
+}
+
+type composeFileReference struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target,omitempty"`
+	UID    string `yaml:"uid,omitempty"`
+	GID    string `yaml:"gid,omitempty"`
+	Mode   uint32 `yaml:"mode"`
+}
+
+type composeNetwork struct {
+	Name       string            `yaml:"name,omitempty"`
+	External   bool              `yaml:"external,omitempty"`
+	Driver     string            `yaml:"driver,omitempty"`
+	Internal   bool              `yaml:"internal,omitempty"`
+	Attachable bool              `yaml:"attachable,omitempty"`
+	EnableIPv6 bool              `yaml:"enable_ipv6,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+	Ipam       *composeIpam      `yaml:"ipam,omitempty"`
+}
+
+type composeIpam struct {
+	Driver string              `yaml:"driver,omitempty"`
+	Config []composeIpamConfig `yaml:"config,omitempty"`
+}
+
+type composeIpamConfig struct {
+	Subnet  string `yaml:"subnet,omitempty"`
+	Gateway string `yaml:"gateway,omitempty"`
+	IPRange string `yaml:"ip_range,omitempty"`
+}
+
+type composeVolume struct {
+	Name       string            `yaml:"name,omitempty"`
+	External   bool              `yaml:"external,omitempty"`
+	Driver     string            `yaml:"driver,omitempty"`
+	DriverOpts map[string]string `yaml:"driver_opts,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+}
+
+type composeFileObject struct {
+	File        string `yaml:"file,omitempty"`
+	Environment string `yaml:"environment,omitempty"`
+	Content     string `yaml:"content,omitempty"`
+}
+
+// MarshalProject serializes a project back into a standalone compose file.
+// The project is written as it was deployed: variables are already
+// interpolated, files merged, env files folded into the environment and
+// services disabled by the active profiles left out. Paths inside the project
+// directory are written relative to it so that the file can be used from a
+// copy of the project on another machine. The content of inline secrets is
+// never written, secrets refer to an environment variable named after them
+// instead
+func MarshalProject(project *Project) ([]byte, error) {
+	output := composeFile{
+		Name:     project.Name,
+		Services: map[string]composeService{},
+	}
+
+	volumeNames := map[string]string{}
+	for _, volume := range project.Volumes {
+		volumeNames[volume.VolumeName] = volume.Name
+	}
+	networkNames := map[string]string{}
+	for _, network := range project.Networks {
+		networkNames[network.NetworkName] = network.Name
+	}
+
+	services := docker.Services{}
+	if project.Core.Name != "" {
+		services = append(services, project.Core)
+	}
+	services = append(services, project.Services...)
+	for idx := range services {
+		if !project.IsServiceEnabled(&services[idx]) {
+			continue
+		}
+		output.Services[services[idx].Name] = exportService(&services[idx], project.WorkingDir, volumeNames, networkNames)
+	}
+
+	if len(project.Networks) > 0 {
+		output.Networks = map[string]composeNetwork{}
+		for _, network := range project.Networks {
+			output.Networks[network.Name] = exportNetwork(network)
+		}
+	}
+	if len(project.Volumes) > 0 {
+		output.Volumes = map[string]composeVolume{}
+		for _, volume := range project.Volumes {
+			output.Volumes[volume.Name] = exportVolume(volume)
+		}
+	}
+	if len(project.Configs) > 0 {
+		output.Configs = map[string]composeFileObject{}
+		for _, config := range project.Configs {
+			output.Configs[config.Name] = exportFileObject(config, project.WorkingDir, false)
+		}
+	}
+	if len(project.Secrets) > 0 {
+		output.Secrets = map[string]composeFileObject{}
+		for _, secret := range project.Secrets {
+			output.Secrets[secret.Name] = exportFileObject(secret, project.WorkingDir, true)
+		}
+	}
+
+	document := yaml.Node{}
+	if err := document.Encode(&output); err != nil {
+		return nil, err
+	}
+	escapeVariables(&document)
+	return yaml.Marshal(&document)
+}
+
+// WriteProject writes the serialized project to the given path
+func WriteProject(project *Project, path string) error {
+	content, err := MarshalProject(project)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+func exportService(service *docker.Service, workingDir string, volumeNames map[string]string, networkNames map[string]string) composeService {
+	output := composeService{
+		PullPolicy:     service.PullPolicy,
+		ContainerName:  service.ContainerName,
+		Hostname:       service.Hostname,
+		Domainname:     service.Domainname,
+		User:           service.User,
+		WorkingDir:     service.WorkingDir,
+		Environment:    service.Environment,
+		Restart:        service.Restart,
+		Init:           service.Init,
+		StopSignal:     service.StopSignal,
+		Tty:            service.Tty,
+		StdinOpen:      service.StdinOpen,
+		Privileged:     service.Privileged,
+		CapAdd:         service.CapAdd,
+		CapDrop:        service.CapDrop,
+		Devices:        service.Devices,
+		NetworkMode:    service.NetworkMode,
+		Ipc:            service.IpcMode,
+		Sysctls:        service.Sysctls,
+		CgroupParent:   service.CgroupParent,
+		CPUs:           service.CPUs,
+		CPUSet:         service.CPUSet,
+		CPUShares:      service.CPUShares,
+		CPUQuota:       service.CPUQuota,
+		CPUPeriod:      service.CPUPeriod,
+		CPURTRuntime:   service.CPURTRuntime,
+		CPURTPeriod:    service.CPURTPeriod,
+		MemLimit:       service.MemLimit,
+		MemSwapLimit:   service.MemSwapLimit,
+		MemReservation: service.MemReservation,
+		OomKillDisable: service.OomKillDisable,
+		PidsLimit:      service.PidsLimit,
+		ShmSize:        service.ShmSize,
+		Expose:         service.Expose,
+		Tmpfs:          service.Tmpfs,
+	}
+	if service.StopGracePeriod != nil {
+		output.StopGracePeriod = service.StopGracePeriod.String()
+	}
+	if service.Logging.Driver != "" || len(service.Logging.Options) > 0 {
+		output.Logging = &composeLogging{
+			Driver:  service.Logging.Driver,
+			Options: service.Logging.Options,
+		}
+	}
+	if service.Image.Name != "" {
+		output.Image = service.Image.Reference()
+	}
+	if service.HasBuild() {
+		build := service.BuildOpt
+		output.Build = &composeBuild{
+			Context:    exportPath(build.Context, workingDir),
+			Dockerfile: build.Dockerfile,
+			Args:       build.Args,
+			Target:     build.Target,
+			Labels:     build.Labels,
+			CacheFrom:  build.CacheFrom,
+			ShmSize:    build.ShmSize,
+			Network:    build.Network,
+			ExtraHosts: build.ExtraHosts,
+		}
+	}
+	// An empty command or entrypoint overrides the one of the image, so only
+	// leave it out when it is not set at all
+	if service.EntryPoint != nil {
+		output.EntryPoint = []string(service.EntryPoint)
+	}
+	if service.Command != nil {
+		output.Command = []string(service.Command)
+	}
+
+	for _, dependency := range service.DependsOn {
+		if output.DependsOn == nil {
+			output.DependsOn = map[string]composeDependency{}
+		}
+		output.DependsOn[dependency.Name] = composeDependency{
+			Condition: dependency.Condition,
+		}
+	}
+
+	for _, ulimit := range service.Ulimits {
+		if output.Ulimits == nil {
+			output.Ulimits = map[string]composeUlimit{}
+		}
+		output.Ulimits[ulimit.Name] = composeUlimit{
+			Soft: ulimit.Soft,
+			Hard: ulimit.Hard,
+		}
+	}
+	if len(service.DeviceRequests) > 0 {
+		output.Deploy = &composeDeploy{}
+		for _, request := range service.DeviceRequests {
+			device := composeDeviceRequest{
+				Driver:       request.Driver,
+				DeviceIDs:    request.DeviceIDs,
+				Capabilities: request.Capabilities,
+				Options:      request.Options,
+			}
+			if request.Count < 0 {
+				if len(request.DeviceIDs) == 0 {
+					device.Count = "all"
+				}
+			} else if request.Count > 0 {
+				device.Count = request.Count
+			}
+			output.Deploy.Resources.Reservations.Devices = append(output.Deploy.Resources.Reservations.Devices, device)
+		}
+	}
+
+	if service.HealthCheck != nil {
+		output.HealthCheck = exportHealthCheck(service.HealthCheck)
+	}
+
+	for _, serviceNetwork := range service.Networks {
+		if output.Networks == nil {
+			output.Networks = map[string]*composeServiceNetwork{}
+		}
+		var networkOpt *composeServiceNetwork
+		if len(serviceNetwork.Aliases) > 0 || serviceNetwork.IPv4 != "" || serviceNetwork.IPv6 != "" {
+			networkOpt = &composeServiceNetwork{
+				Aliases: serviceNetwork.Aliases,
+				IPv4:    serviceNetwork.IPv4,
+				IPv6:    serviceNetwork.IPv6,
+			}
+		}
+		name := serviceNetwork.Name
+		if networkName, ok := networkNames[name]; ok {
+			name = networkName
+		}
+		output.Networks[name] = networkOpt
+	}
+
+	for _, port := range service.Ports {
+		target, _ := strconv.Atoi(port.Target)
+		output.Ports = append(output.Ports, composePort{
+			Target:    target,
+			Published: port.HostPort,
+			HostIp:    port.HostIp,
+			Protocol:  port.Protocol,
+		})
+	}
+
+	for _, volume := range service.Volumes {
+		output.Volumes = append(output.Volumes, exportServiceVolume(volume, workingDir, volumeNames))
+	}
+
+	output.Configs = exportFileReferences(service.Configs)
+	output.Secrets = exportFileReferences(service.Secrets)
+	return output
+}
+
+func exportHealthCheck(healthCheck *docker.HeathCheckConfig) *composeHealthCheck {
+	if healthCheck.Disable {
+		return &composeHealthCheck{
+			Disable: true,
+		}
+	}
+	formatDuration := func(duration time.Duration) string {
+		if duration == 0 {
+			return ""
+		}
+		return duration.String()
+	}
+	return &composeHealthCheck{
+		Test:        healthCheck.Test,
+		Interval:    formatDuration(healthCheck.Interval),
+		Timeout:     formatDuration(healthCheck.Timeout),
+		StartPeriod: formatDuration(healthCheck.StartPeriod),
+		Retries:     healthCheck.Retries,
+	}
+}
+
+// Volumes are written in the long syntax, except bind mounts with options
+// that only the short syntax can express such as SELinux labels
+func exportServiceVolume(volume docker.ServiceVolume, workingDir string, volumeNames map[string]string) interface{} {
+	output := composeVolumeMount{
+		Type:     volume.Type,
+		Source:   volume.Source,
+		Target:   volume.Destination,
+		ReadOnly: volume.ReadOnly,
+	}
+	switch volume.Type {
+	case docker.VolumeTypeBind:
+		output.Source = exportPath(volume.Source, workingDir)
+		longOptions := []string{}
+		if volume.ReadOnly {
+			longOptions = append(longOptions, "ro")
+		}
+		if volume.Propagation != "" {
+			longOptions = append(longOptions, volume.Propagation)
+		}
+		if volume.Option != strings.Join(longOptions, ",") {
+			shortSyntax := output.Source + ":" + volume.Destination
+			if volume.Option != "" {
+				shortSyntax += ":" + volume.Option
+			}
+			return shortSyntax
+		}
+		if volume.Propagation != "" {
+			output.Bind = &composeBindOptions{
+				Propagation: volume.Propagation,
+			}
+		}
+	case docker.VolumeTypeVolume:
+		if name, ok := volumeNames[volume.Source]; ok {
+			output.Source = name
+		}
+		if volume.NoCopy {
+			output.Volume = &composeVolumeMountOptions{
+				NoCopy: true,
+			}
+		}
+	case docker.VolumeTypeTmpfs:
+		if volume.TmpfsSize != 0 || volume.TmpfsMode != 0 {
+			output.Tmpfs = &composeTmpfsOptions{
+				Size: volume.TmpfsSize,
+				Mode: volume.TmpfsMode,
+			}
+		}
+	}
+	return output
+}
+
+// Targets are written in full as they were resolved against the default
+// directory of configs or secrets when the project was loaded
+func exportFileReferences(references []docker.ServiceFileReference) []composeFileReference {
+	output := []composeFileReference{}
+	for _, reference := range references {
+		output = append(output, composeFileReference{
+			Source: reference.Source,
+			Target: reference.Target,
+			UID:    reference.UID,
+			GID:    reference.GID,
+			Mode:   reference.Mode,
+		})
+	}
+	if len(output) == 0 {
+		return nil
+	}
+	return output
+}
+
+func exportNetwork(network docker.Network) composeNetwork {
+	if network.External {
+		return composeNetwork{
+			Name:     network.NetworkName,
+			External: true,
+		}
+	}
+	output := composeNetwork{
+		Driver:     network.Driver,
+		Internal:   network.Internal,
+		Attachable: network.Attachable,
+		EnableIPv6: network.EnableIPv6,
+	}
+	if network.NetworkName != network.Name {
+		output.Name = network.NetworkName
+	}
+	output.Labels = exportLabels(network.Labels)
+	if network.Ipam.Driver != "" || len(network.Ipam.Config) > 0 {
+		output.Ipam = &composeIpam{
+			Driver: network.Ipam.Driver,
+		}
+		for _, config := range network.Ipam.Config {
+			output.Ipam.Config = append(output.Ipam.Config, composeIpamConfig{
+				Subnet:  config.Subnet,
+				Gateway: config.Gateway,
+				IPRange: config.IPRange,
+			})
+		}
+	}
+	return output
+}
+
+func exportVolume(volume docker.Volume) composeVolume {
+	if volume.External {
+		return composeVolume{
+			Name:     volume.VolumeName,
+			External: true,
+		}
+	}
+	output := composeVolume{
+		Name:       volume.VolumeName,
+		Driver:     volume.Driver,
+		DriverOpts: volume.DriverOpts,
+	}
+	output.Labels = exportLabels(volume.Labels)
+	return output
+}
+
+// The labels added by the supervisor are left out as they are added again
+// when the file is loaded
+func exportLabels(labels docker.Labels) map[string]string {
+	var output map[string]string
+	for key, value := range labels {
+		if strings.HasPrefix(key, "ros-supervisor.") {
+			continue
+		}
+		if output == nil {
+			output = map[string]string{}
+		}
+		output[key] = value
+	}
+	return output
+}
+
+func exportFileObject(config docker.Config, workingDir string, secret bool) composeFileObject {
+	output := composeFileObject{
+		Environment: config.Environment,
+		Content:     config.Content,
+	}
+	if secret && config.Content != "" {
+		output.Content = ""
+		output.Environment = secretEnvironmentName(config.Name)
+	}
+	if config.File != "" {
+		output.File = exportPath(config.File, workingDir)
+	}
+	return output
+}
+
+// Name of the environment variable an inline secret is exported as, such as
+// ROS_API_KEY for ros-api.key
+func secretEnvironmentName(name string) string {
+	return strings.Map(func(char rune) rune {
+		if (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
+			return char
+		}
+		if char >= 'a' && char <= 'z' {
+			return char - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+}
+
+// Write a path inside the project directory relative to it
+func exportPath(path string, workingDir string) string {
+	if workingDir == "" || !filepath.IsAbs(path) {
+		return path
+	}
+	relative, err := filepath.Rel(workingDir, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return path
+	}
+	if relative == "." {
+		return "."
+	}
+	return "./" + relative
+}
+
+// Values are already interpolated, so dollar signs are escaped to keep them
+// from being interpolated again when the file is loaded
+func escapeVariables(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			escapeVariables(child)
+		}
+	case yaml.MappingNode:
+		for idx := 1; idx < len(node.Content); idx += 2 {
+			escapeVariables(node.Content[idx])
+		}
+	case yaml.ScalarNode:
+		if node.Tag == "!!str" {
+			node.Value = strings.ReplaceAll(node.Value, "$", "$$")
+		}
+	}
+}
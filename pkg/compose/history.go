@@ -0,0 +1,75 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"go.uber.org/zap"
+)
+
+// Number of images kept per service, including the one in use, so that a
+// service can be rolled back to a previous build
+var ImageHistoryLimit = 3
+
+// Remove the images built for a service that are older than the last
+// ImageHistoryLimit ones. Images used by a container of the project, the
+// rollback image of the service and images still referenced elsewhere are
+// always kept
+func PruneImageHistory(ctx context.Context, dockerClient *client.Client, projectName string, targetService *docker.Service, logger *zap.Logger) error {
+	if ImageHistoryLimit <= 0 {
+		return nil
+	}
+	images, err := dockerClient.ImageList(ctx, types.ImageListOptions{
+		Filters: serviceFilter(projectName, targetService.Name),
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to list images of service %s with error : %s", targetService.Name, err))
+		return err
+	}
+	if len(images) <= ImageHistoryLimit {
+		return nil
+	}
+
+	containers, err := ListProjectContainers(ctx, dockerClient, projectName, logger)
+	if err != nil {
+		return err
+	}
+	inUse := map[string]bool{targetService.Image.ID: true}
+	for _, cnt := range containers {
+		inUse[cnt.ImageID] = true
+	}
+	rollback, _, err := dockerClient.ImageInspectWithRaw(ctx, targetService.Image.Name+":"+RollbackTag)
+	if err == nil {
+		inUse[rollback.ID] = true
+	} else if !errdefs.IsNotFound(err) {
+		logger.Error(fmt.Sprintf("Unable to inspect rollback image of service %s with error: %s", targetService.Name, err))
+		return err
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created > images[j].Created
+	})
+	for _, image := range images[ImageHistoryLimit:] {
+		if inUse[image.ID] {
+			continue
+		}
+		logger.Info(fmt.Sprintf("Removing image %s %v of service %s", image.ID, image.RepoTags, targetService.Name))
+		_, err := dockerClient.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{
+			PruneChildren: true,
+		})
+		if errdefs.IsConflict(err) {
+			// Still referenced by another tag or container
+			logger.Info(fmt.Sprintf("Keeping image %s of service %s as it is still in use", image.ID, targetService.Name))
+			continue
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to remove image %s with error: %s", image.ID, err))
+		}
+	}
+	return nil
+}
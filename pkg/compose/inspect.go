@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"go.uber.org/zap"
@@ -25,3 +26,26 @@ func InspectContainer(ctx context.Context, containerID string, dockerClient *cli
 
 	return info, err
 }
+
+// Inspect the state of the container of a service and the result of its
+// healthcheck. Health is none if the container has no healthcheck
+func InspectServiceState(ctx context.Context, targetService *docker.Service, dockerClient *client.Client, logger *zap.Logger) (docker.ContainerState, error) {
+	state := docker.ContainerState{
+		Status: "missing",
+		Health: types.NoHealthcheck,
+	}
+	if targetService.Container.ID == "" {
+		return state, nil
+	}
+	info, err := InspectContainer(ctx, targetService.Container.ID, dockerClient, logger)
+	if err != nil {
+		return state, err
+	}
+	if info.State != nil {
+		state.Status = info.State.Status
+		if info.State.Health != nil {
+			state.Health = info.State.Health.Status
+		}
+	}
+	return state, nil
+}
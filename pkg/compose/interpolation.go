@@ -0,0 +1,158 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
+)
+
+// Load the variables used for interpolation. Variables of the process take
+// precedence over the ones declared in the .env file of the project
+func LoadEnvironment(projectPath string) (map[string]string, error) {
+	environment := map[string]string{}
+
+	envFile := filepath.Join(projectPath, ".env")
+	if _, err := os.Stat(envFile); err == nil {
+		dotEnv, err := godotenv.Read(envFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read %s", envFile)
+		}
+		for key, value := range dotEnv {
+			environment[key] = value
+		}
+	}
+
+	for _, entry := range os.Environ() {
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) == 2 {
+			environment[split[0]] = split[1]
+		}
+	}
+	return environment, nil
+}
+
+// InterpolateString replaces $VAR and ${VAR} with their values and supports
+// the ${VAR:-default}, ${VAR-default}, ${VAR:?error}, ${VAR?error},
+// ${VAR:+replacement} and ${VAR+replacement} forms. $$ escapes a literal $
+func InterpolateString(value string, environment map[string]string) (string, error) {
+	var output strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] != '$' || idx == len(value)-1 {
+			output.WriteByte(value[idx])
+			continue
+		}
+
+		next := value[idx+1]
+		switch {
+		case next == '$':
+			output.WriteByte('$')
+			idx++
+		case next == '{':
+			end := findClosingBrace(value, idx+2)
+			if end < 0 {
+				return "", errors.Errorf("missing closing brace in %q", value)
+			}
+			substitution, err := substitute(value[idx+2:end], environment)
+			if err != nil {
+				return "", err
+			}
+			output.WriteString(substitution)
+			idx = end
+		case isVariableStart(next):
+			end := idx + 1
+			for end < len(value) && isVariableChar(value[end]) {
+				end++
+			}
+			output.WriteString(environment[value[idx+1:end]])
+			idx = end - 1
+		default:
+			output.WriteByte(value[idx])
+		}
+	}
+	return output.String(), nil
+}
+
+// Substitute the content of a braced expression
+func substitute(expression string, environment map[string]string) (string, error) {
+	end := 0
+	for end < len(expression) && isVariableChar(expression[end]) {
+		end++
+	}
+	name := expression[:end]
+	if name == "" || !isVariableStart(name[0]) {
+		return "", errors.Errorf("invalid variable name in ${%s}", expression)
+	}
+	modifier := expression[end:]
+	value, isSet := environment[name]
+
+	if modifier == "" {
+		return value, nil
+	}
+
+	// A leading colon means empty variables are treated as unset
+	checkEmpty := strings.HasPrefix(modifier, ":")
+	if checkEmpty {
+		modifier = modifier[1:]
+	}
+	if modifier == "" {
+		return "", errors.Errorf("invalid substitution ${%s}", expression)
+	}
+	isPresent := isSet && (!checkEmpty || value != "")
+	operand := modifier[1:]
+
+	switch modifier[0] {
+	case '-':
+		if isPresent {
+			return value, nil
+		}
+		return InterpolateString(operand, environment)
+	case '?':
+		if isPresent {
+			return value, nil
+		}
+		message, err := InterpolateString(operand, environment)
+		if err != nil {
+			return "", err
+		}
+		if message == "" {
+			return "", errors.Errorf("required variable %s is missing a value", name)
+		}
+		return "", errors.Errorf("required variable %s is missing a value: %s", name, message)
+	case '+':
+		if isPresent {
+			return InterpolateString(operand, environment)
+		}
+		return "", nil
+	default:
+		return "", errors.Errorf("invalid substitution ${%s}", expression)
+	}
+}
+
+// Find the brace closing the expression starting at start, taking nested
+// expressions in defaults into account
+func findClosingBrace(value string, start int) int {
+	depth := 1
+	for idx := start; idx < len(value); idx++ {
+		switch value[idx] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+func isVariableStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isVariableChar(c byte) bool {
+	return isVariableStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,54 @@
+package compose
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Hash of the configuration of a service. State assigned once the service is
+// deployed, such as the ids of its image and container or the commit it is
+// built from, is left out so that the hash only changes with the compose files
+func ServiceConfigHash(targetService *docker.Service) string {
+	config := *targetService
+	config.Container = docker.Container{}
+	config.Image.ID = ""
+	config.Image.Created = ""
+	config.Commit = ""
+	config.BuildOpt.Revision = ""
+	content, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// Labels identifying the container and the image of a service
+func serviceLabels(projectName string, targetService *docker.Service) docker.Labels {
+	labels := docker.Labels{
+		docker.LabelProject:    projectName,
+		docker.LabelService:    targetService.Name,
+		docker.LabelConfigHash: ServiceConfigHash(targetService),
+		docker.LabelVersion:    docker.SupervisorVersion,
+	}
+	if targetService.Commit != "" {
+		labels[docker.LabelCommit] = targetService.Commit
+	}
+	return labels
+}
+
+// Filter matching the resources created by the supervisor for a project
+func projectFilter(projectName string) filters.Args {
+	return filters.NewArgs(filters.Arg("label", docker.LabelProject+"="+projectName))
+}
+
+// Filter matching the resources created by the supervisor for a service
+func serviceFilter(projectName string, serviceName string) filters.Args {
+	args := projectFilter(projectName)
+	args.Add("label", docker.LabelService+"="+serviceName)
+	return args
+}
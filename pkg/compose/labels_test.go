@@ -0,0 +1,76 @@
+package compose
+
+import (
+	"testing"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+)
+
+func TestServiceConfigHash(t *testing.T) {
+	base := func() docker.Service {
+		return docker.Service{
+			Name:        "app",
+			Image:       docker.Image{Name: "project_app", Tag: "latest"},
+			BuildOpt:    docker.ServiceBuild{Context: "/project/app"},
+			Environment: []string{"A=1"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(service *docker.Service)
+		changed bool
+	}{
+		{
+			name:   "identical services",
+			change: func(service *docker.Service) {},
+		},
+		{
+			name: "deployed state is left out",
+			change: func(service *docker.Service) {
+				service.Container = docker.Container{ID: "container", Name: "project_app"}
+				service.Image.ID = "sha256:image"
+				service.Image.Created = "2021-01-01"
+				service.Commit = "abc"
+				service.BuildOpt.Revision = "def"
+			},
+		},
+		{
+			name: "environment is part of the configuration",
+			change: func(service *docker.Service) {
+				service.Environment = []string{"A=2"}
+			},
+			changed: true,
+		},
+		{
+			name: "image reference is part of the configuration",
+			change: func(service *docker.Service) {
+				service.Image.Tag = "v2"
+			},
+			changed: true,
+		},
+		{
+			name: "build context is part of the configuration",
+			change: func(service *docker.Service) {
+				service.BuildOpt.Context = "/project/other"
+			},
+			changed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := base()
+			changed := base()
+			test.change(&changed)
+			originalHash := ServiceConfigHash(&original)
+			changedHash := ServiceConfigHash(&changed)
+			if originalHash == "" || changedHash == "" {
+				t.Fatal("expected a hash")
+			}
+			if (originalHash != changedHash) != test.changed {
+				t.Errorf("expected hash change %t, got %s and %s", test.changed, originalHash, changedHash)
+			}
+		})
+	}
+}
@@ -9,18 +9,15 @@ import (
 	"go.uber.org/zap"
 )
 
-func ListAllContainers(ctx context.Context, dockerClient *client.Client, logger *zap.Logger) ([]types.Container, error) {
-	containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true})
+// List the containers created by the supervisor for a project, whether they
+// are running or not
+func ListProjectContainers(ctx context.Context, dockerClient *client.Client, projectName string, logger *zap.Logger) ([]types.Container, error) {
+	containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: projectFilter(projectName),
+	})
 	if err != nil {
-		logger.Error(fmt.Sprintf("Unable to list all containers with error : %s", err))
+		logger.Error(fmt.Sprintf("Unable to list containers of project %s with error : %s", projectName, err))
 	}
 	return containers, err
 }
-
-func ListAllImages(ctx context.Context, dockerClient *client.Client, logger *zap.Logger) ([]types.ImageSummary, error) {
-	images, err := dockerClient.ImageList(ctx, types.ImageListOptions{})
-	if err != nil {
-		logger.Error(fmt.Sprintf("Unable to list all images with error : %s", err))
-	}
-	return images, err
-}
@@ -0,0 +1,432 @@
+package compose
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/dkhoanguyen/ros-supervisor/pkg/schema"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const OverrideComposeFile = "docker-compose.override.yml"
+
+// Sections are identified by their path in the compose file, with the names
+// of services and top level resources replaced by "*" (see sectionPath)
+
+// Sections that are written either as a list of "KEY=VALUE" or as a mapping,
+// and are merged as mappings
+var mappingSections = map[string]bool{
+	"services.*.environment":       true,
+	"services.*.labels":            true,
+	"services.*.build.args":        true,
+	"services.*.build.labels":      true,
+	"services.*.build.extra_hosts": true,
+	"services.*.deploy.labels":     true,
+	"services.*.sysctls":           true,
+	"services.*.extra_hosts":       true,
+	"networks.*.labels":            true,
+	"volumes.*.labels":             true,
+	"configs.*.labels":             true,
+	"secrets.*.labels":             true,
+}
+
+// Sections of a service that are written either as a list of names or as a
+// mapping from name to options, and are merged as mappings
+var namedSections = map[string]bool{
+	"services.*.networks":   true,
+	"services.*.depends_on": true,
+}
+
+// Sections that are replaced as a whole instead of being merged
+var replacedSections = map[string]bool{
+	"services.*.command":          true,
+	"services.*.entrypoint":       true,
+	"services.*.healthcheck.test": true,
+	"services.*.profiles":         true,
+}
+
+// Top level sections whose entries are named by the user
+var namedTopLevelSections = map[string]bool{
+	"services": true,
+	"networks": true,
+	"volumes":  true,
+	"configs":  true,
+	"secrets":  true,
+}
+
+// Add the override file of the project if a single compose file is given and
+// the override file exists next to it, as docker compose does
+func ResolveComposeFiles(composeFiles []string) []string {
+	if len(composeFiles) != 1 {
+		return composeFiles
+	}
+	overrideFile := filepath.Join(filepath.Dir(composeFiles[0]), OverrideComposeFile)
+	if _, err := os.Stat(overrideFile); err == nil && overrideFile != composeFiles[0] {
+		return append(composeFiles, overrideFile)
+	}
+	return composeFiles
+}
+
+// Load the compose files in order and merge each of them onto the previous
+// ones. Each file is interpolated and its extends are resolved before merging
+func LoadComposeFiles(composeFiles []string, environment map[string]string) (map[interface{}]interface{}, error) {
+	if len(composeFiles) == 0 {
+		return nil, errors.New("no docker-compose file given")
+	}
+	merged := map[string]interface{}{}
+	for _, composeFile := range composeFiles {
+		rawData, err := loadComposeFile(composeFile, environment)
+		if err != nil {
+			return nil, err
+		}
+		if err := resolveExtends(rawData, composeFile, environment, []string{}); err != nil {
+			return nil, err
+		}
+		merged = mergeMappings(merged, rawData, nil)
+	}
+
+	output := make(map[interface{}]interface{})
+	for key, value := range merged {
+		output[key] = value
+	}
+	return output, nil
+}
+
+func loadComposeFile(composeFile string, environment map[string]string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(composeFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read docker-compose file %s", composeFile)
+	}
+	if err := schema.Validate(composeFile, content, ComposeSchema); err != nil {
+		return nil, err
+	}
+	// Values are interpolated before the file is decoded so that they are
+	// given the type the compose specification expects
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, errors.Wrapf(err, "unable to extract docker-compose file %s", composeFile)
+	}
+	err = schema.Resolve(composeFile, &document, ComposeSchema, func(value string) (string, error) {
+		return InterpolateString(value, environment)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to interpolate docker-compose file %s", composeFile)
+	}
+	rawData := make(map[string]interface{})
+	if err := document.Decode(&rawData); err != nil {
+		return nil, errors.Wrapf(err, "unable to extract docker-compose file %s", composeFile)
+	}
+	return rawData, nil
+}
+
+// Replace every service which extends another one with the merge of the
+// extended service and its own configuration. The chain of services being
+// resolved is used to detect cycles
+func resolveExtends(rawData map[string]interface{}, composeFile string, environment map[string]string, chain []string) error {
+	services, ok := rawData["services"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for serviceName := range services {
+		resolved, err := resolveServiceExtends(services, serviceName, composeFile, environment, chain)
+		if err != nil {
+			return err
+		}
+		services[serviceName] = resolved
+	}
+	return nil
+}
+
+func resolveServiceExtends(services map[string]interface{}, serviceName string, composeFile string, environment map[string]string, chain []string) (interface{}, error) {
+	serviceConfig, ok := services[serviceName].(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("service %s is not defined in %s", serviceName, composeFile)
+	}
+	rawExtends, ok := serviceConfig["extends"]
+	if !ok {
+		return serviceConfig, nil
+	}
+
+	link := composeFile + ":" + serviceName
+	for _, previous := range chain {
+		if previous == link {
+			return nil, errors.Errorf("circular extends: %s", strings.Join(append(chain, link), " -> "))
+		}
+	}
+	chain = append(chain, link)
+
+	baseFile := composeFile
+	baseName := ""
+	switch extends := rawExtends.(type) {
+	case string:
+		baseName = extends
+	case map[string]interface{}:
+		baseName, _ = extends["service"].(string)
+		if file, ok := extends["file"].(string); ok {
+			baseFile = file
+			if !filepath.IsAbs(baseFile) {
+				baseFile = filepath.Join(filepath.Dir(composeFile), baseFile)
+			}
+		}
+	}
+	if baseName == "" {
+		return nil, errors.Errorf("extends of service %s in %s has no service", serviceName, composeFile)
+	}
+
+	baseServices := services
+	if baseFile != composeFile {
+		baseData, err := loadComposeFile(baseFile, environment)
+		if err != nil {
+			return nil, err
+		}
+		baseServices, ok = baseData["services"].(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s has no services", baseFile)
+		}
+	}
+	base, err := resolveServiceExtends(baseServices, baseName, baseFile, environment, chain)
+	if err != nil {
+		return nil, err
+	}
+	baseConfig := copyMapping(base.(map[string]interface{}))
+	if baseFile != composeFile {
+		// Relative paths of the base service are relative to its own file
+		baseDir, err := filepath.Abs(filepath.Dir(baseFile))
+		if err != nil {
+			return nil, err
+		}
+		rebaseServicePaths(baseConfig, baseDir)
+	}
+
+	extension := map[string]interface{}{}
+	for key, value := range serviceConfig {
+		if key != "extends" {
+			extension[key] = value
+		}
+	}
+	return mergeMappings(baseConfig, extension, []string{"services", serviceName}), nil
+}
+
+// Make the relative host paths of a service absolute, taking them relative to
+// baseDir: the build context, the env files and the sources of bind mounts
+func rebaseServicePaths(serviceConfig map[string]interface{}, baseDir string) {
+	rebase := func(path string) string {
+		if filepath.IsAbs(path) || strings.HasPrefix(path, "~") {
+			return path
+		}
+		return filepath.Join(baseDir, path)
+	}
+
+	switch build := serviceConfig["build"].(type) {
+	case string:
+		if !urlutil.IsGitURL(build) {
+			serviceConfig["build"] = rebase(build)
+		}
+	case map[string]interface{}:
+		rebased := copyMapping(build)
+		context, ok := rebased["context"].(string)
+		if !ok {
+			context = "."
+		}
+		if !urlutil.IsGitURL(context) {
+			rebased["context"] = rebase(context)
+		}
+		serviceConfig["build"] = rebased
+	}
+
+	switch envFile := serviceConfig["env_file"].(type) {
+	case string:
+		serviceConfig["env_file"] = rebase(envFile)
+	case []interface{}:
+		rebased := make([]interface{}, len(envFile))
+		for idx, path := range envFile {
+			rebased[idx] = rebase(toString(path))
+		}
+		serviceConfig["env_file"] = rebased
+	}
+
+	volumes, ok := serviceConfig["volumes"].([]interface{})
+	if !ok {
+		return
+	}
+	rebased := make([]interface{}, len(volumes))
+	for idx, volume := range volumes {
+		rebased[idx] = volume
+		switch volumeOpt := volume.(type) {
+		case string:
+			split := strings.SplitN(volumeOpt, ":", 2)
+			if len(split) == 2 && isBindSource(split[0]) {
+				rebased[idx] = rebase(split[0]) + ":" + split[1]
+			}
+		case map[string]interface{}:
+			source, ok := volumeOpt["source"].(string)
+			if volumeOpt["type"] == docker.VolumeTypeBind && ok {
+				volumeCopy := copyMapping(volumeOpt)
+				volumeCopy["source"] = rebase(source)
+				rebased[idx] = volumeCopy
+			}
+		}
+	}
+	serviceConfig["volumes"] = rebased
+}
+
+// Merge the override mapping onto the base mapping following the compose
+// specification. path is the location of the mappings in the compose file
+func mergeMappings(base map[string]interface{}, override map[string]interface{}, path []string) map[string]interface{} {
+	for overrideKey, overrideValue := range override {
+		baseValue, ok := base[overrideKey]
+		if !ok {
+			base[overrideKey] = overrideValue
+			continue
+		}
+		keyPath := append(append([]string{}, path...), overrideKey)
+		base[overrideKey] = mergeValues(baseValue, overrideValue, keyPath)
+	}
+	return base
+}
+
+func mergeValues(base interface{}, override interface{}, path []string) interface{} {
+	section := sectionPath(path)
+	key := path[len(path)-1]
+	if replacedSections[section] || override == nil {
+		return override
+	}
+	if mappingSections[section] {
+		return mergeMappings(toRawMapping(base, key), toRawMapping(override, key), path)
+	}
+	if namedSections[section] {
+		return mergeMappings(toNamedMapping(base), toNamedMapping(override), path)
+	}
+
+	switch overrideValue := override.(type) {
+	case map[string]interface{}:
+		if baseValue, ok := base.(map[string]interface{}); ok {
+			return mergeMappings(copyMapping(baseValue), overrideValue, path)
+		}
+	case []interface{}:
+		if baseValue, ok := base.([]interface{}); ok {
+			return mergeSequences(baseValue, overrideValue, section)
+		}
+	}
+	return override
+}
+
+// Path of a section with the names of services and top level resources
+// replaced by "*", such as services.*.healthcheck.test
+func sectionPath(path []string) string {
+	section := append([]string{}, path...)
+	if len(section) > 1 && namedTopLevelSections[section[0]] {
+		section[1] = "*"
+	}
+	return strings.Join(section, ".")
+}
+
+// Sequences are merged by their identifying field where the specification
+// defines one, otherwise override entries are appended if not present yet
+func mergeSequences(base []interface{}, override []interface{}, section string) []interface{} {
+	identify := func(entry interface{}) string {
+		return fmt.Sprintf("%v", entry)
+	}
+	switch section {
+	case "services.*.volumes", "services.*.devices":
+		identify = mountTarget
+	case "services.*.secrets", "services.*.configs":
+		identify = func(entry interface{}) string {
+			if mapping, ok := entry.(map[string]interface{}); ok {
+				if target, ok := mapping["target"]; ok {
+					return toString(target)
+				}
+				return toString(mapping["source"])
+			}
+			return toString(entry)
+		}
+	}
+
+	output := append([]interface{}{}, base...)
+	for _, entry := range override {
+		replaced := false
+		for idx, existing := range output {
+			if identify(existing) == identify(entry) {
+				output[idx] = entry
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			output = append(output, entry)
+		}
+	}
+	return output
+}
+
+// Mount target of a volume or device in either the short or the long syntax
+func mountTarget(entry interface{}) string {
+	switch v := entry.(type) {
+	case string:
+		split := strings.Split(v, ":")
+		if len(split) == 1 {
+			return split[0]
+		}
+		return split[1]
+	case map[string]interface{}:
+		return toString(v["target"])
+	}
+	return fmt.Sprintf("%v", entry)
+}
+
+func toRawMapping(value interface{}, key string) map[string]interface{} {
+	separator := "="
+	if key == "extra_hosts" {
+		separator = ":"
+	}
+	output := map[string]interface{}{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for entryKey, entry := range v {
+			output[entryKey] = entry
+		}
+	case []interface{}:
+		for _, entry := range v {
+			split := strings.SplitN(toString(entry), separator, 2)
+			if len(split) > 1 {
+				output[split[0]] = split[1]
+			} else {
+				output[split[0]] = nil
+			}
+		}
+	}
+	return output
+}
+
+func toNamedMapping(value interface{}) map[string]interface{} {
+	output := map[string]interface{}{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, entry := range v {
+			output[key] = entry
+		}
+	case []interface{}:
+		for _, entry := range v {
+			output[toString(entry)] = nil
+		}
+	}
+	return output
+}
+
+func copyMapping(value map[string]interface{}) map[string]interface{} {
+	output := map[string]interface{}{}
+	for key, entry := range value {
+		if mapping, ok := entry.(map[string]interface{}); ok {
+			output[key] = copyMapping(mapping)
+		} else {
+			output[key] = entry
+		}
+	}
+	return output
+}
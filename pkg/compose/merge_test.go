@@ -0,0 +1,139 @@
+package compose
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     map[string]interface{}
+		override map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name: "environment list and mapping are merged by key",
+			base: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"environment": []interface{}{"A=1", "B=2"},
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"environment": map[string]interface{}{"B": "3", "C": "4"},
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"environment": map[string]interface{}{"A": "1", "B": "3", "C": "4"},
+			}}},
+		},
+		{
+			name: "command is replaced",
+			base: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"command": []interface{}{"run", "--a"},
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"command": []interface{}{"run"},
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"command": []interface{}{"run"},
+			}}},
+		},
+		{
+			name: "healthcheck test is replaced and other options merged",
+			base: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"healthcheck": map[string]interface{}{"test": []interface{}{"CMD", "a"}, "retries": 3},
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"healthcheck": map[string]interface{}{"test": []interface{}{"CMD", "b"}},
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"healthcheck": map[string]interface{}{"test": []interface{}{"CMD", "b"}, "retries": 3},
+			}}},
+		},
+		{
+			name: "service named test is merged",
+			base: map[string]interface{}{"services": map[string]interface{}{"test": map[string]interface{}{
+				"image": "a", "restart": "always",
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"test": map[string]interface{}{
+				"image": "b",
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"test": map[string]interface{}{
+				"image": "b", "restart": "always",
+			}}},
+		},
+		{
+			name: "service named environment is not merged as a mapping section",
+			base: map[string]interface{}{"services": map[string]interface{}{"environment": map[string]interface{}{
+				"ports": []interface{}{"80:80"},
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"environment": map[string]interface{}{
+				"ports": []interface{}{"81:81"},
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"environment": map[string]interface{}{
+				"ports": []interface{}{"80:80", "81:81"},
+			}}},
+		},
+		{
+			name: "volumes are merged by target",
+			base: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"volumes": []interface{}{"./a:/data", "./b:/b"},
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"volumes": []interface{}{"./c:/data"},
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"volumes": []interface{}{"./c:/data", "./b:/b"},
+			}}},
+		},
+		{
+			name: "depends_on list and mapping are merged by name",
+			base: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"depends_on": []interface{}{"db"},
+			}}},
+			override: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"depends_on": map[string]interface{}{"cache": map[string]interface{}{"condition": "service_healthy"}},
+			}}},
+			expected: map[string]interface{}{"services": map[string]interface{}{"app": map[string]interface{}{
+				"depends_on": map[string]interface{}{"db": nil, "cache": map[string]interface{}{"condition": "service_healthy"}},
+			}}},
+		},
+		{
+			name: "network labels are merged as a mapping",
+			base: map[string]interface{}{"networks": map[string]interface{}{"labels": map[string]interface{}{
+				"labels": []interface{}{"a=1"},
+			}}},
+			override: map[string]interface{}{"networks": map[string]interface{}{"labels": map[string]interface{}{
+				"labels": []interface{}{"b=2"},
+			}}},
+			expected: map[string]interface{}{"networks": map[string]interface{}{"labels": map[string]interface{}{
+				"labels": map[string]interface{}{"a": "1", "b": "2"},
+			}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := mergeMappings(test.base, test.override, nil)
+			if !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, merged)
+			}
+		})
+	}
+}
+
+func TestSectionPath(t *testing.T) {
+	tests := []struct {
+		path     []string
+		expected string
+	}{
+		{[]string{"services", "test"}, "services.*"},
+		{[]string{"services", "app", "healthcheck", "test"}, "services.*.healthcheck.test"},
+		{[]string{"networks", "environment", "labels"}, "networks.*.labels"},
+		{[]string{"version"}, "version"},
+		{[]string{"x-common", "command"}, "x-common.command"},
+	}
+	for _, test := range tests {
+		if section := sectionPath(test.path); section != test.expected {
+			t.Errorf("sectionPath(%v): expected %s, got %s", test.path, test.expected, section)
+		}
+	}
+}
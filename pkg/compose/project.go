@@ -1,26 +1,38 @@
 package compose
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 )
 
 type Project struct {
-	Name        string `json:"name"`
-	WorkingDir  string `json:"working_dir"`
-	Core        docker.Service
-	Services    docker.Services `json:"services"`
-	Networks    docker.Networks `json:"networks"`
-	Volumes     docker.Volumes  `json:"volumes"`
-	Configs     docker.Configs  `json:"configs"`
-	ComposeFile []byte          `json:"compose_file"`
+	Name           string   `json:"name"`
+	WorkingDir     string   `json:"working_dir"`
+	ActiveProfiles []string `json:"active_profiles"`
+	Core           docker.Service
+	Services       docker.Services `json:"services"`
+	Networks       docker.Networks `json:"networks"`
+	Volumes        docker.Volumes  `json:"volumes"`
+	Configs        docker.Configs  `json:"configs"`
+	Secrets        docker.Secrets  `json:"secrets"`
+	ComposeFile    []byte          `json:"compose_file"`
 }
 
 func (project *Project) ServiceNames() []string {
@@ -48,67 +60,147 @@ func (project Project) GetService(name string) docker.Service {
 	return docker.Service{}
 }
 
-// Restructure services based on dependencies
-func (project *Project) RestructureServices(logger *zap.Logger) {
-	logger.Info("Organising services based on dependencies hierarchy")
-	restructureServices := docker.Services{}
-	numDepends := make([]int, 0)
-	numDepends = append(numDepends, 0)
-	find := func(element int, arr []int) bool {
-		for _, d := range arr {
-			if element == d {
+// Services without profiles are always enabled, others only when at least one
+// of their profiles is active
+func (project *Project) IsServiceEnabled(targetService *docker.Service) bool {
+	if len(targetService.Profiles) == 0 {
+		return true
+	}
+	for _, profile := range targetService.Profiles {
+		for _, activeProfile := range project.ActiveProfiles {
+			if profile == activeProfile || activeProfile == "*" {
 				return true
 			}
 		}
-		return false
-	}
-	for _, service := range project.Services {
-		if !find(len(service.DependsOn), numDepends) {
-			numDepends = append(numDepends, len(service.DependsOn))
-		}
 	}
+	return false
+}
 
-	sort.Ints(numDepends)
-
-	for _, nd := range numDepends {
-		for _, service := range project.Services {
-			if len(service.DependsOn) == nd {
-				restructureServices = append(restructureServices, service)
+// Make sure enabled services do not depend on services disabled by profiles
+func (project *Project) validateProfiles() error {
+	for idx := range project.Services {
+		if !project.IsServiceEnabled(&project.Services[idx]) {
+			continue
+		}
+		for _, dependency := range project.Services[idx].DependsOn {
+			dependencyService := project.GetService(dependency.Name)
+			if dependencyService.Name != "" && !project.IsServiceEnabled(&dependencyService) {
+				return errors.Errorf("service %s depends on %s which is disabled by the active profiles", project.Services[idx].Name, dependency.Name)
 			}
 		}
 	}
+	return nil
+}
 
+// Restructure services in topological order of their dependencies, so that
+// every service comes after the services it depends on. Services without
+// ordering constraints between them are kept sorted by name. Core is always
+// started first and is not part of the graph
+func (project *Project) RestructureServices(logger *zap.Logger) error {
+	logger.Info("Organising services based on dependencies hierarchy")
+	graph, err := NewDependencyGraph(project)
+	if err != nil {
+		return err
+	}
+	order, err := graph.TopologicalOrder()
+	if err != nil {
+		return err
+	}
+
+	restructureServices := docker.Services{}
+	for _, name := range order {
+		restructureServices = append(restructureServices, project.GetService(name))
+	}
 	project.Services = restructureServices
+	return nil
+}
+
+// Contents of the compose files before interpolation, as one YAML document
+// per file
+func readRawComposeFiles(composeFiles []string) ([]byte, error) {
+	documents := [][]byte{}
+	for _, composeFile := range composeFiles {
+		content, err := ioutil.ReadFile(composeFile)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, bytes.TrimSuffix(content, []byte("\n")))
+	}
+	return append(bytes.Join(documents, []byte("\n---\n")), '\n'), nil
 }
 
-func CreateProject(dockerComposePath, projectPath string, logger *zap.Logger) Project {
+// Load, validate and extract the compose files of a project. Errors are
+// returned rather than fatal so that the caller can keep the last good project
+func CreateProject(dockerComposePaths []string, projectPath string, activeProfiles []string, logger *zap.Logger) (Project, error) {
 	outputProject := Project{}
-	composeFile, err := ioutil.ReadFile(dockerComposePath)
+	outputProject.ActiveProfiles = activeProfiles
+	dockerComposePaths = ResolveComposeFiles(dockerComposePaths)
+	logger.Info(fmt.Sprintf("Loading docker-compose files %s", strings.Join(dockerComposePaths, ", ")))
+	environment, err := LoadEnvironment(projectPath)
 	if err != nil {
-		logger.Fatal("Unable to read docker-compose file.")
+		return outputProject, errors.Wrap(err, "unable to load environment")
 	}
-	rawData := make(map[interface{}]interface{})
-	err2 := yaml.Unmarshal(composeFile, &rawData)
-	if err2 != nil {
-		logger.Fatal("Unable to extract docker-compose file.")
+	rawData, err := LoadComposeFiles(dockerComposePaths, environment)
+	if err != nil {
+		return outputProject, err
+	}
+	if _, ok := rawData["services"].(map[string]interface{}); !ok {
+		return outputProject, errors.New("docker-compose files define no services")
 	}
 	slicedProjectPath := strings.Split(projectPath, "/")
 
 	outputProject.Name = slicedProjectPath[len(slicedProjectPath)-2]
 	outputProject.WorkingDir = projectPath
 
-	outputProject.Services, outputProject.Core = extractServices(rawData, projectPath, logger)
-	outputProject.Networks = extractNetworks(rawData, logger)
-	outputProject.Volumes = extractVolumes(rawData, logger)
+	outputProject.Services, outputProject.Core, err = extractServices(rawData, projectPath, environment, logger)
+	if err != nil {
+		return outputProject, err
+	}
+	outputProject.Networks = extractNetworks(rawData, outputProject.Name, logger)
+	outputProject.Volumes = extractVolumes(rawData, outputProject.Name, logger)
+	outputProject.Configs = extractConfigs(rawData, projectPath, environment, logger)
+	outputProject.Secrets = extractSecrets(rawData, projectPath, environment, logger)
+
+	setDefaultContainerName(&outputProject.Core, outputProject.Name)
+	resolveServiceVolumes(&outputProject.Core, outputProject.Volumes, logger)
+	resolveServiceNetworks(&outputProject.Core, outputProject.Networks, logger)
+	resolveServiceFileReferences(&outputProject.Core, outputProject.Configs, outputProject.Secrets, logger)
+	resolveServiceModes(&outputProject.Core, outputProject.Name)
+	for idx := range outputProject.Services {
+		setDefaultContainerName(&outputProject.Services[idx], outputProject.Name)
+		resolveServiceModes(&outputProject.Services[idx], outputProject.Name)
+		resolveServiceVolumes(&outputProject.Services[idx], outputProject.Volumes, logger)
+		resolveServiceNetworks(&outputProject.Services[idx], outputProject.Networks, logger)
+		resolveServiceFileReferences(&outputProject.Services[idx], outputProject.Configs, outputProject.Secrets, logger)
+	}
 
+	// The files are kept as they were written: interpolated values, secrets
+	// passed through variables included, must not be held in the project
+	composeFile, err := readRawComposeFiles(dockerComposePaths)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to read docker-compose files with error: %s", err))
+	}
 	outputProject.ComposeFile = composeFile
 
-	outputProject.RestructureServices(logger)
+	if err := outputProject.validateProfiles(); err != nil {
+		return outputProject, errors.Wrap(err, "unable to enable services")
+	}
+	if err := outputProject.RestructureServices(logger); err != nil {
+		return outputProject, errors.Wrap(err, "unable to organise services")
+	}
 
-	return outputProject
+	return outputProject, nil
 }
 
-func extractSingleService(serviceName string, serviceConfig interface{}, projectPath string, logger *zap.Logger) docker.Service {
+// Services without a container name are named after the project, matching the
+// names used for service network modes
+func setDefaultContainerName(targetService *docker.Service, projectName string) {
+	if targetService.ContainerName == "" && targetService.Name != "" {
+		targetService.ContainerName = projectName + "_" + targetService.Name
+	}
+}
+
+func extractSingleService(serviceName string, serviceConfig interface{}, projectPath string, environment map[string]string, logger *zap.Logger) (docker.Service, error) {
 	dService := docker.Service{}
 	logger.Info(fmt.Sprintf("Extracting %s", serviceName))
 
@@ -116,91 +208,1042 @@ func extractSingleService(serviceName string, serviceConfig interface{}, project
 	dService.Name = serviceName
 
 	// Build options and setups
-	buildOpt := serviceConfig.(map[string]interface{})["build"].(map[string]interface{})
-	dService.BuildOpt.Context = projectPath
-	dService.BuildOpt.Dockerfile = buildOpt["dockerfile"].(string)
+	if buildOpt, ok := serviceConfig.(map[string]interface{})["build"]; ok {
+		buildConfig, err := extractBuildConfig(buildOpt, projectPath, environment)
+		if err != nil {
+			return dService, errors.Wrapf(err, "unable to extract build section of service %s", serviceName)
+		}
+		dService.BuildOpt = buildConfig
+	}
+
+	// Image
+	if imageOpt, ok := serviceConfig.(map[string]interface{})["image"].(string); ok {
+		image, err := extractImage(imageOpt)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to extract image %s of service %s with error: %s", imageOpt, serviceName, err))
+		}
+		dService.Image = image
+	}
+
+	// Profiles
+	if profilesOpt, ok := serviceConfig.(map[string]interface{})["profiles"].([]interface{}); ok {
+		for _, profile := range profilesOpt {
+			dService.Profiles = append(dService.Profiles, toString(profile))
+		}
+	}
+
+	// Pull policy
+	if pullPolicyOpt, ok := serviceConfig.(map[string]interface{})["pull_policy"].(string); ok {
+		dService.PullPolicy = pullPolicyOpt
+		if pullPolicyOpt == "if_not_present" {
+			dService.PullPolicy = docker.PullPolicyMissing
+		}
+	}
 
 	// Container name
-	dService.ContainerName = serviceConfig.(map[string]interface{})["container_name"].(string)
+	if containerName, ok := serviceConfig.(map[string]interface{})["container_name"].(string); ok {
+		dService.ContainerName = containerName
+	}
 
 	// Depends On
-	if dependsOn, ok := serviceConfig.(map[string]interface{})["depends_on"].([]interface{}); ok {
+	dService.DependsOn = make([]docker.ServiceDependency, 0)
+	switch dependsOn := serviceConfig.(map[string]interface{})["depends_on"].(type) {
+	case []interface{}:
 		for _, dp := range dependsOn {
-			// fmt.Printf("%s\n", dp.(string))
-			dService.DependsOn = append(dService.DependsOn, dp.(string))
+			dService.DependsOn = append(dService.DependsOn, docker.ServiceDependency{
+				Name:      toString(dp),
+				Condition: docker.ConditionServiceStarted,
+			})
+		}
+	case map[string]interface{}:
+		for name, dp := range dependsOn {
+			dependency := docker.ServiceDependency{
+				Name:      name,
+				Condition: docker.ConditionServiceStarted,
+			}
+			if dpOpt, ok := dp.(map[string]interface{}); ok {
+				if condition, ok := dpOpt["condition"].(string); ok {
+					dependency.Condition = condition
+				}
+			}
+			dService.DependsOn = append(dService.DependsOn, dependency)
 		}
-	} else {
-		// Crucial as this is required to sort all services based on dependencies
-		dService.DependsOn = make([]string, 0)
+		sort.Slice(dService.DependsOn, func(i, j int) bool {
+			return dService.DependsOn[i].Name < dService.DependsOn[j].Name
+		})
 	}
 
-	// Environment variables
-	if envVarsOpt, ok := serviceConfig.(map[string]interface{})["environment"].([]interface{}); ok {
-		for _, envVars := range envVarsOpt {
-			dService.Environment = append(dService.Environment, envVars.(string))
+	// Env files
+	switch envFileOpt := serviceConfig.(map[string]interface{})["env_file"].(type) {
+	case string:
+		dService.EnvFile = append(dService.EnvFile, resolveHostPath(envFileOpt, projectPath))
+	case []interface{}:
+		for _, envFile := range envFileOpt {
+			dService.EnvFile = append(dService.EnvFile, resolveHostPath(toString(envFile), projectPath))
 		}
 	}
 
+	// Environment variables
+	serviceEnvironment, err := extractServiceEnvironment(dService.EnvFile, serviceConfig.(map[string]interface{})["environment"], environment)
+	if err != nil {
+		return dService, errors.Wrapf(err, "unable to extract environment of service %s", serviceName)
+	}
+	dService.Environment = serviceEnvironment
+
 	// Restart
 	if restartOpt, ok := serviceConfig.(map[string]interface{})["restart"].(string); ok {
 		dService.Restart = restartOpt
 	}
 
 	// Networks
-	if networkOpts, ok := serviceConfig.(map[string]interface{})["networks"].(map[string]interface{}); ok {
-		for name, network := range networkOpts {
-			// fmt.Printf("%s:%s\n", name, network.(map[string]interface{})["ipv4_address"].(string))
+	switch networkOpts := serviceConfig.(map[string]interface{})["networks"].(type) {
+	case []interface{}:
+		for _, name := range networkOpts {
 			dService.Networks = append(dService.Networks, docker.ServiceNetwork{
-				Name: name,
-				IPv4: network.(map[string]interface{})["ipv4_address"].(string),
+				Name: toString(name),
 			})
 		}
+	case map[string]interface{}:
+		for name, network := range networkOpts {
+			dService.Networks = append(dService.Networks, extractServiceNetwork(name, network))
+		}
+		// Keep the order of networks stable as the first one is used when
+		// creating the container
+		sort.Slice(dService.Networks, func(i, j int) bool {
+			return dService.Networks[i].Name < dService.Networks[j].Name
+		})
+	}
+
+	// Process and runtime
+	if err := extractRuntime(serviceConfig.(map[string]interface{}), &dService); err != nil {
+		return dService, errors.Wrapf(err, "unable to extract runtime options of service %s", serviceName)
+	}
+
+	// Resources are rejected as a whole rather than applied partially
+	if err := extractResources(serviceConfig.(map[string]interface{}), &dService); err != nil {
+		return dService, errors.Wrapf(err, "unable to extract resources of service %s", serviceName)
+	}
+
+	// Healthcheck
+	if healthCheckOpt, ok := serviceConfig.(map[string]interface{})["healthcheck"].(map[string]interface{}); ok {
+		healthCheck, err := extractHealthCheck(healthCheckOpt)
+		if err != nil {
+			return dService, errors.Wrapf(err, "unable to extract healthcheck of service %s", serviceName)
+		}
+		dService.HealthCheck = healthCheck
 	}
 
+	// Ports
+	if portOpts, ok := serviceConfig.(map[string]interface{})["ports"].([]interface{}); ok {
+		for _, port := range portOpts {
+			ports, err := extractServicePort(port)
+			if err != nil {
+				return dService, errors.Wrapf(err, "unable to extract port %v of service %s", port, serviceName)
+			}
+			dService.Ports = append(dService.Ports, ports...)
+		}
+	}
+
+	// Expose
+	if exposeOpts, ok := serviceConfig.(map[string]interface{})["expose"].([]interface{}); ok {
+		for _, expose := range exposeOpts {
+			dService.Expose = append(dService.Expose, toString(expose))
+		}
+	}
+
+	// Volumes
 	if volumeOpts, ok := serviceConfig.(map[string]interface{})["volumes"].([]interface{}); ok {
 		for _, volume := range volumeOpts {
-			// fmt.Printf("%s\n", volume.(string))
-			fromStringToVolume := func(volStr string) docker.ServiceVolume {
-				separateValues := strings.Split(volStr, ":")
-				if len(separateValues) >= 2 {
-					return docker.ServiceVolume{
-						Type:        docker.VolumeTypeBind,
-						Source:      separateValues[0],
-						Destination: separateValues[1],
+			dVolume, err := extractServiceVolume(volume, projectPath)
+			if err != nil {
+				return dService, errors.Wrapf(err, "unable to extract volume %v of service %s", volume, serviceName)
+			}
+			dService.Volumes = append(dService.Volumes, dVolume)
+		}
+	}
+
+	// Configs and secrets
+	if configsOpt, ok := serviceConfig.(map[string]interface{})["configs"].([]interface{}); ok {
+		configs, err := extractServiceFileReferences(configsOpt, "/", docker.DefaultFileMode)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to extract configs of service %s with error: %s", serviceName, err))
+		}
+		dService.Configs = configs
+	}
+	if secretsOpt, ok := serviceConfig.(map[string]interface{})["secrets"].([]interface{}); ok {
+		secrets, err := extractServiceFileReferences(secretsOpt, docker.DefaultSecretsDir, docker.DefaultSecretMode)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to extract secrets of service %s with error: %s", serviceName, err))
+		}
+		dService.Secrets = secrets
+	}
+
+	// Tmpfs
+	switch tmpfsOpt := serviceConfig.(map[string]interface{})["tmpfs"].(type) {
+	case string:
+		dService.Tmpfs = append(dService.Tmpfs, tmpfsOpt)
+	case []interface{}:
+		for _, tmpfs := range tmpfsOpt {
+			dService.Tmpfs = append(dService.Tmpfs, toString(tmpfs))
+		}
+	}
+
+	return dService, nil
+}
+
+// Extract the build section, which is either the path to the build context or
+// a mapping with the context, dockerfile and build options
+func extractBuildConfig(rawBuildConfig interface{}, projectPath string, environment map[string]string) (docker.ServiceBuild, error) {
+	buildConfig := docker.ServiceBuild{
+		Context:    projectPath,
+		Dockerfile: "Dockerfile",
+	}
+	switch buildOpt := rawBuildConfig.(type) {
+	case string:
+		buildConfig.Context = resolveBuildContext(buildOpt, projectPath)
+	case map[string]interface{}:
+		if context, ok := buildOpt["context"].(string); ok {
+			buildConfig.Context = resolveBuildContext(context, projectPath)
+		}
+		if dockerfile, ok := buildOpt["dockerfile"].(string); ok {
+			buildConfig.Dockerfile = dockerfile
+		}
+		if args, ok := buildOpt["args"]; ok {
+			buildConfig.Args = toMappingWithEquals(args)
+			// Arguments without a value are taken from the project
+			// environment, as for interpolation, or left to the default of the
+			// Dockerfile if they are not set
+			for key, value := range buildConfig.Args {
+				if value == nil {
+					if envValue, ok := environment[key]; ok {
+						buildConfig.Args[key] = &envValue
 					}
 				}
-				return docker.ServiceVolume{}
 			}
-			dService.Volumes = append(dService.Volumes, fromStringToVolume(volume.(string)))
 		}
-	} else {
-		dService.Volumes = append(dService.Volumes, docker.ServiceVolume{})
+		if target, ok := buildOpt["target"].(string); ok {
+			buildConfig.Target = target
+		}
+		if labels, ok := buildOpt["labels"]; ok {
+			buildConfig.Labels = docker.Labels{}
+			for key, value := range toMappingWithEquals(labels) {
+				if value != nil {
+					buildConfig.Labels[key] = *value
+				} else {
+					buildConfig.Labels[key] = ""
+				}
+			}
+		}
+		if cacheFrom, ok := buildOpt["cache_from"].([]interface{}); ok {
+			for _, cache := range cacheFrom {
+				buildConfig.CacheFrom = append(buildConfig.CacheFrom, toString(cache))
+			}
+		}
+		if shmSize, ok := buildOpt["shm_size"]; ok {
+			size, err := toBytes(shmSize)
+			if err != nil {
+				return buildConfig, err
+			}
+			buildConfig.ShmSize = size
+		}
+		if network, ok := buildOpt["network"].(string); ok {
+			buildConfig.Network = network
+		}
+		if extraHosts, ok := buildOpt["extra_hosts"]; ok {
+			buildConfig.ExtraHosts = toExtraHosts(extraHosts)
+		}
+	default:
+		return buildConfig, errors.Errorf("unsupported build format %v", rawBuildConfig)
+	}
+	return buildConfig, nil
+}
+
+// Split an image reference such as "ros:noetic-ros-core" into its name and
+// tag or digest. The tag defaults to latest as with the docker CLI
+func extractImage(rawImage string) (docker.Image, error) {
+	named, err := reference.ParseNormalizedNamed(rawImage)
+	if err != nil {
+		return docker.Image{}, err
+	}
+	image := docker.Image{
+		Name: reference.FamiliarName(named),
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		image.Digest = digested.Digest().String()
+		return image, nil
+	}
+	image.Tag = "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		image.Tag = tagged.Tag()
+	}
+	return image, nil
+}
+
+// Merge the variables of the env files with the environment section, which
+// takes precedence. Variables declared without a value are resolved from the
+// environment of the supervisor and dropped if they are not set there
+func extractServiceEnvironment(envFiles []string, rawEnvironment interface{}, environment map[string]string) ([]string, error) {
+	variables := map[string]string{}
+	for _, envFile := range envFiles {
+		fileVariables, err := godotenv.Read(envFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read env file %s", envFile)
+		}
+		for key, value := range fileVariables {
+			variables[key] = value
+		}
+	}
+	for key, value := range toMappingWithEquals(rawEnvironment) {
+		if value != nil {
+			variables[key] = *value
+		} else if envValue, ok := environment[key]; ok {
+			variables[key] = envValue
+		}
+	}
+
+	keys := make([]string, 0, len(variables))
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	output := []string{}
+	for _, key := range keys {
+		output = append(output, key+"="+variables[key])
+	}
+	return output, nil
+}
+
+// Extract a network of a service written in the mapping form, where the
+// network configuration is optional
+func extractServiceNetwork(name string, rawNetwork interface{}) docker.ServiceNetwork {
+	serviceNetwork := docker.ServiceNetwork{
+		Name: name,
+	}
+	networkOpt, ok := rawNetwork.(map[string]interface{})
+	if !ok {
+		return serviceNetwork
+	}
+	if aliases, ok := networkOpt["aliases"].([]interface{}); ok {
+		for _, alias := range aliases {
+			serviceNetwork.Aliases = append(serviceNetwork.Aliases, toString(alias))
+		}
+	}
+	if ipv4, ok := networkOpt["ipv4_address"].(string); ok {
+		serviceNetwork.IPv4 = ipv4
+	}
+	if ipv6, ok := networkOpt["ipv6_address"].(string); ok {
+		serviceNetwork.IPv6 = ipv6
+	}
+	return serviceNetwork
+}
+
+// Extract the options describing the process of a service and the runtime of
+// its container
+func extractRuntime(serviceOpt map[string]interface{}, dService *docker.Service) error {
+	if command, ok := serviceOpt["command"]; ok {
+		parsed, err := toShellCommand(command)
+		if err != nil {
+			return errors.Wrap(err, "invalid command")
+		}
+		dService.Command = parsed
+	}
+	if entrypoint, ok := serviceOpt["entrypoint"]; ok {
+		parsed, err := toShellCommand(entrypoint)
+		if err != nil {
+			return errors.Wrap(err, "invalid entrypoint")
+		}
+		dService.EntryPoint = parsed
+	}
+
+	stringOpts := map[string]*string{
+		"user":          &dService.User,
+		"working_dir":   &dService.WorkingDir,
+		"hostname":      &dService.Hostname,
+		"domainname":    &dService.Domainname,
+		"network_mode":  &dService.NetworkMode,
+		"ipc":           &dService.IpcMode,
+		"cgroup_parent": &dService.CgroupParent,
+	}
+	for key, value := range stringOpts {
+		if rawValue, ok := serviceOpt[key]; ok {
+			*value = toString(rawValue)
+		}
+	}
+
+	boolOpts := map[string]*bool{
+		"tty":        &dService.Tty,
+		"stdin_open": &dService.StdinOpen,
+		"privileged": &dService.Privileged,
+	}
+	for key, value := range boolOpts {
+		if rawValue, ok := serviceOpt[key]; ok {
+			parsed, ok := rawValue.(bool)
+			if !ok {
+				return errors.Errorf("%s must be a boolean", key)
+			}
+			*value = parsed
+		}
+	}
+
+	listOpts := map[string]*[]string{
+		"cap_add":  &dService.CapAdd,
+		"cap_drop": &dService.CapDrop,
+		"devices":  &dService.Devices,
+	}
+	for key, value := range listOpts {
+		if rawValue, ok := serviceOpt[key].([]interface{}); ok {
+			for _, entry := range rawValue {
+				*value = append(*value, toString(entry))
+			}
+		}
 	}
 
-	return dService
+	if stopSignal, ok := serviceOpt["stop_signal"].(string); ok {
+		dService.StopSignal = stopSignal
+	}
+	if stopGracePeriod, ok := serviceOpt["stop_grace_period"]; ok {
+		parsed, err := toDuration(stopGracePeriod)
+		if err != nil {
+			return errors.Wrap(err, "invalid stop_grace_period")
+		}
+		dService.StopGracePeriod = &parsed
+	}
+	if init, ok := serviceOpt["init"]; ok {
+		parsed, ok := init.(bool)
+		if !ok {
+			return errors.New("init must be a boolean")
+		}
+		dService.Init = &parsed
+	}
+	if logging, ok := serviceOpt["logging"].(map[string]interface{}); ok {
+		if driver, ok := logging["driver"].(string); ok {
+			dService.Logging.Driver = driver
+		}
+		if options, ok := logging["options"].(map[string]interface{}); ok {
+			dService.Logging.Options = map[string]string{}
+			for key, value := range options {
+				dService.Logging.Options[key] = toString(value)
+			}
+		}
+	}
+
+	if sysctls, ok := serviceOpt["sysctls"]; ok {
+		dService.Sysctls = map[string]string{}
+		for key, value := range toMappingWithEquals(sysctls) {
+			if value == nil {
+				return errors.Errorf("sysctl %s has no value", key)
+			}
+			dService.Sysctls[key] = *value
+		}
+	}
+	return nil
 }
 
-func extractServices(rawData map[interface{}]interface{}, projectPath string, logger *zap.Logger) (docker.Services, docker.Service) {
+// Extract the resource constraints of a service. Limits and reservations of
+// the deploy section only apply when the equivalent service key is not set
+func extractResources(serviceOpt map[string]interface{}, dService *docker.Service) error {
+	byteSizes := map[string]*int64{
+		"mem_limit":       &dService.MemLimit,
+		"memswap_limit":   &dService.MemSwapLimit,
+		"mem_reservation": &dService.MemReservation,
+		"shm_size":        &dService.ShmSize,
+	}
+	for key, size := range byteSizes {
+		if rawSize, ok := serviceOpt[key]; ok {
+			parsed, err := toBytes(rawSize)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s", key)
+			}
+			*size = parsed
+		}
+	}
+
+	microseconds := map[string]*int64{
+		"cpu_quota":      &dService.CPUQuota,
+		"cpu_period":     &dService.CPUPeriod,
+		"cpu_rt_runtime": &dService.CPURTRuntime,
+		"cpu_rt_period":  &dService.CPURTPeriod,
+	}
+	for key, value := range microseconds {
+		if rawValue, ok := serviceOpt[key]; ok {
+			parsed, err := toMicroseconds(rawValue)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s", key)
+			}
+			*value = parsed
+		}
+	}
+
+	if cpus, ok := serviceOpt["cpus"]; ok {
+		parsed, err := toFloat(cpus)
+		if err != nil {
+			return errors.Wrap(err, "invalid cpus")
+		}
+		dService.CPUs = parsed
+	}
+	if cpuset, ok := serviceOpt["cpuset"]; ok {
+		dService.CPUSet = toString(cpuset)
+	}
+	if cpuShares, ok := serviceOpt["cpu_shares"].(int); ok {
+		dService.CPUShares = int64(cpuShares)
+	}
+	if pidsLimit, ok := serviceOpt["pids_limit"].(int); ok {
+		dService.PidsLimit = int64(pidsLimit)
+	}
+	if oomKillDisable, ok := serviceOpt["oom_kill_disable"].(bool); ok {
+		dService.OomKillDisable = oomKillDisable
+	}
+
+	if ulimits, ok := serviceOpt["ulimits"].(map[string]interface{}); ok {
+		for name, rawUlimit := range ulimits {
+			ulimit := docker.ServiceUlimit{
+				Name: name,
+			}
+			switch limit := rawUlimit.(type) {
+			case int:
+				ulimit.Soft = int64(limit)
+				ulimit.Hard = int64(limit)
+			case map[string]interface{}:
+				soft, softOk := limit["soft"].(int)
+				hard, hardOk := limit["hard"].(int)
+				if !softOk || !hardOk {
+					return errors.Errorf("ulimit %s requires both soft and hard", name)
+				}
+				ulimit.Soft = int64(soft)
+				ulimit.Hard = int64(hard)
+			default:
+				return errors.Errorf("unsupported ulimit %s", name)
+			}
+			dService.Ulimits = append(dService.Ulimits, ulimit)
+		}
+		sort.Slice(dService.Ulimits, func(i, j int) bool {
+			return dService.Ulimits[i].Name < dService.Ulimits[j].Name
+		})
+	}
+
+	deploy, _ := serviceOpt["deploy"].(map[string]interface{})
+	resources, _ := deploy["resources"].(map[string]interface{})
+	if limits, ok := resources["limits"].(map[string]interface{}); ok {
+		if cpus, ok := limits["cpus"]; ok && dService.CPUs == 0 {
+			parsed, err := toFloat(cpus)
+			if err != nil {
+				return errors.Wrap(err, "invalid deploy.resources.limits.cpus")
+			}
+			dService.CPUs = parsed
+		}
+		if memory, ok := limits["memory"]; ok && dService.MemLimit == 0 {
+			parsed, err := toBytes(memory)
+			if err != nil {
+				return errors.Wrap(err, "invalid deploy.resources.limits.memory")
+			}
+			dService.MemLimit = parsed
+		}
+		if pids, ok := limits["pids"].(int); ok && dService.PidsLimit == 0 {
+			dService.PidsLimit = int64(pids)
+		}
+	}
+	if reservations, ok := resources["reservations"].(map[string]interface{}); ok {
+		if memory, ok := reservations["memory"]; ok && dService.MemReservation == 0 {
+			parsed, err := toBytes(memory)
+			if err != nil {
+				return errors.Wrap(err, "invalid deploy.resources.reservations.memory")
+			}
+			dService.MemReservation = parsed
+		}
+		if devices, ok := reservations["devices"].([]interface{}); ok {
+			for _, rawDevice := range devices {
+				deviceOpt, ok := rawDevice.(map[string]interface{})
+				if !ok {
+					return errors.Errorf("unsupported device reservation %v", rawDevice)
+				}
+				dService.DeviceRequests = append(dService.DeviceRequests, extractDeviceRequest(deviceOpt))
+			}
+		}
+	}
+	return nil
+}
+
+// Extract a device reservation such as a GPU. A request without count nor
+// device ids reserves all matching devices
+func extractDeviceRequest(deviceOpt map[string]interface{}) docker.ServiceDeviceRequest {
+	request := docker.ServiceDeviceRequest{}
+	if driver, ok := deviceOpt["driver"].(string); ok {
+		request.Driver = driver
+	}
+	switch count := deviceOpt["count"].(type) {
+	case int:
+		request.Count = count
+	case string:
+		if count == "all" {
+			request.Count = -1
+		}
+	}
+	if deviceIDs, ok := deviceOpt["device_ids"].([]interface{}); ok {
+		for _, id := range deviceIDs {
+			request.DeviceIDs = append(request.DeviceIDs, toString(id))
+		}
+	}
+	if request.Count == 0 && len(request.DeviceIDs) == 0 {
+		request.Count = -1
+	}
+	if capabilities, ok := deviceOpt["capabilities"].([]interface{}); ok {
+		for _, capability := range capabilities {
+			request.Capabilities = append(request.Capabilities, toString(capability))
+		}
+	}
+	if options, ok := deviceOpt["options"].(map[string]interface{}); ok {
+		request.Options = map[string]string{}
+		for key, value := range options {
+			request.Options[key] = toString(value)
+		}
+	}
+	return request
+}
+
+// Extract the healthcheck section. A test written as a string is run with the
+// default shell of the container
+func extractHealthCheck(healthCheckOpt map[string]interface{}) (*docker.HeathCheckConfig, error) {
+	healthCheck := docker.HeathCheckConfig{}
+	if disable, ok := healthCheckOpt["disable"].(bool); ok && disable {
+		healthCheck.Disable = true
+		return &healthCheck, nil
+	}
+
+	switch test := healthCheckOpt["test"].(type) {
+	case string:
+		healthCheck.Test = []string{"CMD-SHELL", test}
+	case []interface{}:
+		for _, arg := range test {
+			healthCheck.Test = append(healthCheck.Test, toString(arg))
+		}
+	case nil:
+	default:
+		return nil, errors.Errorf("unsupported healthcheck test %v", test)
+	}
+	if len(healthCheck.Test) > 0 && healthCheck.Test[0] == "NONE" {
+		healthCheck.Disable = true
+		return &healthCheck, nil
+	}
+
+	durations := map[string]*time.Duration{
+		"interval":     &healthCheck.Interval,
+		"timeout":      &healthCheck.Timeout,
+		"start_period": &healthCheck.StartPeriod,
+	}
+	for key, duration := range durations {
+		if rawDuration, ok := healthCheckOpt[key]; ok {
+			parsed, err := toDuration(rawDuration)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid healthcheck %s", key)
+			}
+			*duration = parsed
+		}
+	}
+	if retries, ok := healthCheckOpt["retries"].(int); ok {
+		healthCheck.Retries = retries
+	}
+	return &healthCheck, nil
+}
+
+// Extract a single entry of the ports section, which can be written either in
+// the short syntax "[HOST_IP:][HOST_PORT:]CONTAINER_PORT[/PROTOCOL]" or in the
+// long syntax with target, published, host_ip and protocol keys
+func extractServicePort(rawPort interface{}) ([]docker.ServicePort, error) {
+	outputPorts := []docker.ServicePort{}
+	switch port := rawPort.(type) {
+	case int, string:
+		mappings, err := nat.ParsePortSpec(toString(port))
+		if err != nil {
+			return nil, err
+		}
+		for _, mapping := range mappings {
+			outputPorts = append(outputPorts, docker.ServicePort{
+				Target:   mapping.Port.Port(),
+				Protocol: mapping.Port.Proto(),
+				HostIp:   mapping.Binding.HostIP,
+				HostPort: mapping.Binding.HostPort,
+			})
+		}
+	case map[string]interface{}:
+		target, ok := port["target"]
+		if !ok {
+			return nil, errors.New("missing target in long syntax port")
+		}
+		servicePort := docker.ServicePort{
+			Target:   toString(target),
+			Protocol: "tcp",
+		}
+		if _, err := nat.ParsePort(servicePort.Target); err != nil {
+			return nil, errors.Errorf("invalid target port %s", servicePort.Target)
+		}
+		if published, ok := port["published"]; ok {
+			servicePort.HostPort = toString(published)
+		}
+		if hostIp, ok := port["host_ip"].(string); ok {
+			servicePort.HostIp = hostIp
+		}
+		if protocol, ok := port["protocol"].(string); ok {
+			servicePort.Protocol = strings.ToLower(protocol)
+		}
+		outputPorts = append(outputPorts, servicePort)
+	default:
+		return nil, errors.Errorf("unsupported port format %v", rawPort)
+	}
+	return outputPorts, nil
+}
+
+// Extract a single entry of the volumes section, which can be written either in
+// the short syntax "[SOURCE:]TARGET[:MODE]" or in the long syntax with type,
+// source, target, read_only and the type specific options
+func extractServiceVolume(rawVolume interface{}, projectPath string) (docker.ServiceVolume, error) {
+	switch volume := rawVolume.(type) {
+	case string:
+		return extractShortSyntaxVolume(volume, projectPath)
+	case map[string]interface{}:
+		return extractLongSyntaxVolume(volume, projectPath)
+	default:
+		return docker.ServiceVolume{}, errors.Errorf("unsupported volume format %v", rawVolume)
+	}
+}
+
+func extractShortSyntaxVolume(volStr string, projectPath string) (docker.ServiceVolume, error) {
+	separateValues := strings.Split(volStr, ":")
+	switch len(separateValues) {
+	case 1:
+		// Anonymous volume
+		return docker.ServiceVolume{
+			Type:        docker.VolumeTypeVolume,
+			Destination: separateValues[0],
+		}, nil
+	case 2, 3:
+		dVolume := docker.ServiceVolume{
+			Source:      separateValues[0],
+			Destination: separateValues[1],
+		}
+		if len(separateValues) == 3 {
+			dVolume.Option = separateValues[2]
+		}
+		if isBindSource(dVolume.Source) {
+			dVolume.Type = docker.VolumeTypeBind
+			dVolume.Source = resolveHostPath(dVolume.Source, projectPath)
+		} else {
+			dVolume.Type = docker.VolumeTypeVolume
+		}
+		for _, option := range strings.Split(dVolume.Option, ",") {
+			switch option {
+			case "ro":
+				dVolume.ReadOnly = true
+			case "nocopy":
+				dVolume.NoCopy = true
+			}
+		}
+		return dVolume, nil
+	default:
+		return docker.ServiceVolume{}, errors.Errorf("invalid volume specification %s", volStr)
+	}
+}
+
+func extractLongSyntaxVolume(volume map[string]interface{}, projectPath string) (docker.ServiceVolume, error) {
+	dVolume := docker.ServiceVolume{}
+	volumeType, ok := volume["type"].(string)
+	if !ok {
+		return dVolume, errors.New("missing type in long syntax volume")
+	}
+	target, ok := volume["target"].(string)
+	if !ok {
+		return dVolume, errors.New("missing target in long syntax volume")
+	}
+	dVolume.Type = volumeType
+	dVolume.Destination = target
+	if source, ok := volume["source"].(string); ok {
+		dVolume.Source = source
+	}
+	if readOnly, ok := volume["read_only"].(bool); ok {
+		dVolume.ReadOnly = readOnly
+	}
+
+	switch volumeType {
+	case docker.VolumeTypeBind:
+		if dVolume.Source == "" {
+			return dVolume, errors.Errorf("missing source for bind mount %s", target)
+		}
+		dVolume.Source = resolveHostPath(dVolume.Source, projectPath)
+		if bindOpt, ok := volume["bind"].(map[string]interface{}); ok {
+			if propagation, ok := bindOpt["propagation"].(string); ok {
+				dVolume.Propagation = propagation
+			}
+		}
+		options := []string{}
+		if dVolume.ReadOnly {
+			options = append(options, "ro")
+		}
+		if dVolume.Propagation != "" {
+			options = append(options, dVolume.Propagation)
+		}
+		dVolume.Option = strings.Join(options, ",")
+	case docker.VolumeTypeVolume:
+		if volumeOpt, ok := volume["volume"].(map[string]interface{}); ok {
+			if noCopy, ok := volumeOpt["nocopy"].(bool); ok {
+				dVolume.NoCopy = noCopy
+			}
+		}
+	case docker.VolumeTypeTmpfs:
+		if dVolume.Source != "" {
+			return dVolume, errors.Errorf("tmpfs mount %s does not accept a source", target)
+		}
+		if tmpfsOpt, ok := volume["tmpfs"].(map[string]interface{}); ok {
+			if size, ok := tmpfsOpt["size"]; ok {
+				tmpfsSize, err := toBytes(size)
+				if err != nil {
+					return dVolume, err
+				}
+				dVolume.TmpfsSize = tmpfsSize
+			}
+			if mode, ok := tmpfsOpt["mode"].(int); ok {
+				dVolume.TmpfsMode = uint32(mode)
+			}
+		}
+	default:
+		return dVolume, errors.Errorf("unsupported volume type %s", volumeType)
+	}
+	return dVolume, nil
+}
+
+// A volume source is a host path if it is either absolute or relative to the
+// project, otherwise it refers to a named volume
+func isBindSource(source string) bool {
+	return filepath.IsAbs(source) || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~")
+}
+
+// Git repositories are used as build context as they are, other contexts are
+// paths on the host
+func resolveBuildContext(context string, projectPath string) string {
+	if urlutil.IsGitURL(context) {
+		return context
+	}
+	return resolveHostPath(context, projectPath)
+}
+
+func resolveHostPath(source string, projectPath string) string {
+	if strings.HasPrefix(source, "~") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, source[1:])
+		}
+	}
+	if !filepath.IsAbs(source) {
+		return filepath.Join(projectPath, source)
+	}
+	return source
+}
+
+// Convert a byte size which is either an integer or a human readable string
+// such as "64m" into its number of bytes
+func toBytes(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case string:
+		return units.RAMInBytes(v)
+	default:
+		return 0, errors.Errorf("invalid byte size %v", value)
+	}
+}
+
+// Convert a section written either as a list of "KEY=VALUE" or as a mapping
+// into a mapping. Keys without a value are mapped to nil
+func toMappingWithEquals(value interface{}) map[string]*string {
+	output := map[string]*string{}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, entry := range v {
+			split := strings.SplitN(toString(entry), "=", 2)
+			if len(split) > 1 {
+				output[split[0]] = &split[1]
+			} else {
+				output[split[0]] = nil
+			}
+		}
+	case map[string]interface{}:
+		for key, entry := range v {
+			if entry == nil {
+				output[key] = nil
+				continue
+			}
+			entryStr := toString(entry)
+			output[key] = &entryStr
+		}
+	}
+	return output
+}
+
+// Convert extra hosts written either as a list of "HOST:IP" or as a mapping
+// into the "HOST:IP" list expected by the docker API
+func toExtraHosts(value interface{}) []string {
+	output := []string{}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, entry := range v {
+			output = append(output, toString(entry))
+		}
+	case map[string]interface{}:
+		for host, ip := range v {
+			output = append(output, host+":"+toString(ip))
+		}
+		sort.Strings(output)
+	}
+	return output
+}
+
+// Convert a duration such as "1m30s" into a time.Duration
+func toDuration(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case int:
+		return time.Duration(v) * time.Second, nil
+	default:
+		return 0, errors.Errorf("invalid duration %v", value)
+	}
+}
+
+// Convert a command written either as a list of arguments or as a string,
+// which is split into arguments like a shell does
+func toShellCommand(value interface{}) (docker.ShellCommand, error) {
+	switch v := value.(type) {
+	case string:
+		return splitShellWords(v)
+	case []interface{}:
+		command := docker.ShellCommand{}
+		for _, arg := range v {
+			command = append(command, toString(arg))
+		}
+		return command, nil
+	case nil:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unsupported command %v", value)
+	}
+}
+
+// Split a string into words following the quoting rules of a POSIX shell,
+// without performing any expansion
+func splitShellWords(value string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for idx := 0; idx < len(value); idx++ {
+		c := value[idx]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if idx+1 < len(value) {
+				idx++
+				word.WriteByte(value[idx])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(value[idx+1:], '\'')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated single quote in %q", value)
+			}
+			word.WriteString(value[idx+1 : idx+1+end])
+			idx += end + 1
+		case c == '"':
+			inWord = true
+			idx++
+			for ; idx < len(value) && value[idx] != '"'; idx++ {
+				if value[idx] == '\\' && idx+1 < len(value) && strings.IndexByte("\"\\$`", value[idx+1]) >= 0 {
+					idx++
+				}
+				word.WriteByte(value[idx])
+			}
+			if idx >= len(value) {
+				return nil, errors.Errorf("unterminated double quote in %q", value)
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// Convert a duration written either as microseconds or as a string such as
+// "400ms" into microseconds
+func toMicroseconds(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, err
+		}
+		return duration.Microseconds(), nil
+	default:
+		return 0, errors.Errorf("invalid duration %v", value)
+	}
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, errors.Errorf("invalid number %v", value)
+	}
+}
+
+// Convert a scalar yaml value into its string representation
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func extractServices(rawData map[interface{}]interface{}, projectPath string, environment map[string]string, logger *zap.Logger) (docker.Services, docker.Service, error) {
 	logger.Debug("Extracting all services")
 	outputServices := docker.Services{}
 	coreService := docker.Service{}
 	rawServices := rawData["services"].(map[string]interface{})
 
 	for serviceName, serviceConfig := range rawServices {
+		dService, err := extractSingleService(serviceName, serviceConfig, projectPath, environment, logger)
+		if err != nil {
+			return outputServices, coreService, err
+		}
 		if serviceName == "core" {
 			logger.Info("Extracting core separately")
-			coreService = extractSingleService(serviceName, serviceConfig, projectPath, logger)
+			coreService = dService
 			continue
 		}
-
-		dService := extractSingleService(serviceName, serviceConfig, projectPath, logger)
 		outputServices = append(outputServices, dService)
 	}
 
-	return outputServices, coreService
+	return outputServices, coreService, nil
 }
 
-func extractNetworks(rawData map[interface{}]interface{}, logger *zap.Logger) docker.Networks {
+func extractNetworks(rawData map[interface{}]interface{}, projectName string, logger *zap.Logger) docker.Networks {
 
 	logger.Debug("Extracting networks")
 	outputNetworks := docker.Networks{}
@@ -209,20 +1252,77 @@ func extractNetworks(rawData map[interface{}]interface{}, logger *zap.Logger) do
 		for networkName, rawNetwork := range rawNetworks {
 			dNetwork := docker.Network{}
 			dNetwork.Name = networkName
+			dNetwork.NetworkName = networkName
 			dNetwork.CheckDuplicate = true
 			dNetwork.EnableIPv6 = false
 			dNetwork.Internal = false
-			dNetwork.Driver = rawNetwork.(map[string]interface{})["driver"].(string)
+			dNetwork.Driver = "bridge"
+			dNetwork.Labels = docker.Labels{
+				docker.LabelProject: projectName,
+				docker.LabelNetwork: networkName,
+				docker.LabelVersion: docker.SupervisorVersion,
+			}
 
-			ipam := rawNetwork.(map[string]interface{})["ipam"]
-			ipamConfig := ipam.(map[string]interface{})["config"].([]interface{})
+			networkOpt, ok := rawNetwork.(map[string]interface{})
+			if !ok {
+				outputNetworks = append(outputNetworks, dNetwork)
+				continue
+			}
+			if labels, ok := networkOpt["labels"]; ok {
+				for key, value := range toMappingWithEquals(labels) {
+					if _, ok := dNetwork.Labels[key]; ok {
+						continue
+					}
+					if value != nil {
+						dNetwork.Labels[key] = *value
+					} else {
+						dNetwork.Labels[key] = ""
+					}
+				}
+			}
+			if name, ok := networkOpt["name"].(string); ok {
+				dNetwork.NetworkName = name
+			}
+			if external, ok := networkOpt["external"].(bool); ok && external {
+				dNetwork.External = true
+				outputNetworks = append(outputNetworks, dNetwork)
+				continue
+			}
+			if driver, ok := networkOpt["driver"].(string); ok {
+				dNetwork.Driver = driver
+			}
+			if enableIPv6, ok := networkOpt["enable_ipv6"].(bool); ok {
+				dNetwork.EnableIPv6 = enableIPv6
+			}
+			if internal, ok := networkOpt["internal"].(bool); ok {
+				dNetwork.Internal = internal
+			}
+			if attachable, ok := networkOpt["attachable"].(bool); ok {
+				dNetwork.Attachable = attachable
+			}
 
-			for _, config := range ipamConfig {
-				ipamConfig := network.IPAMConfig{
-					Subnet:  config.(map[string]interface{})["subnet"].(string),
-					Gateway: config.(map[string]interface{})["gateway"].(string),
+			if ipam, ok := networkOpt["ipam"].(map[string]interface{}); ok {
+				if driver, ok := ipam["driver"].(string); ok {
+					dNetwork.Ipam.Driver = driver
+				}
+				ipamConfig, _ := ipam["config"].([]interface{})
+				for _, config := range ipamConfig {
+					configOpt, ok := config.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					ipamConfig := network.IPAMConfig{}
+					if subnet, ok := configOpt["subnet"].(string); ok {
+						ipamConfig.Subnet = subnet
+					}
+					if gateway, ok := configOpt["gateway"].(string); ok {
+						ipamConfig.Gateway = gateway
+					}
+					if ipRange, ok := configOpt["ip_range"].(string); ok {
+						ipamConfig.IPRange = ipRange
+					}
+					dNetwork.Ipam.Config = append(dNetwork.Ipam.Config, ipamConfig)
 				}
-				dNetwork.Ipam.Config = append(dNetwork.Ipam.Config, ipamConfig)
 			}
 			outputNetworks = append(outputNetworks, dNetwork)
 		}
@@ -230,53 +1330,145 @@ func extractNetworks(rawData map[interface{}]interface{}, logger *zap.Logger) do
 	return outputNetworks
 }
 
-func extractVolumes(rawData map[interface{}]interface{}, logger *zap.Logger) docker.Volumes {
+func extractVolumes(rawData map[interface{}]interface{}, projectName string, logger *zap.Logger) docker.Volumes {
 	logger.Debug("Extracting volumes")
 	outputVolumes := docker.Volumes{}
 	if rawVolumes, ok := rawData["volumes"].(map[string]interface{}); ok {
-		for volumeName := range rawVolumes {
+		for volumeName, rawVolume := range rawVolumes {
 			dVolume := docker.Volume{}
 			dVolume.Name = volumeName
+			dVolume.VolumeName = projectName + "_" + volumeName
+			dVolume.Labels = docker.Labels{}
+
+			if volumeOpt, ok := rawVolume.(map[string]interface{}); ok {
+				// External volumes are looked up by their own name rather
+				// than the name scoped to the project
+				if external, ok := volumeOpt["external"].(bool); ok && external {
+					dVolume.External = true
+					dVolume.VolumeName = volumeName
+				}
+				if name, ok := volumeOpt["name"].(string); ok {
+					dVolume.VolumeName = name
+				}
+				if driver, ok := volumeOpt["driver"].(string); ok {
+					dVolume.Driver = driver
+				}
+				if driverOpts, ok := volumeOpt["driver_opts"].(map[string]interface{}); ok {
+					dVolume.DriverOpts = make(map[string]string)
+					for key, value := range driverOpts {
+						dVolume.DriverOpts[key] = toString(value)
+					}
+				}
+				if labels, ok := volumeOpt["labels"].(map[string]interface{}); ok {
+					for key, value := range labels {
+						dVolume.Labels[key] = toString(value)
+					}
+				}
+			}
+			dVolume.Labels[docker.LabelProject] = projectName
+			dVolume.Labels[docker.LabelVolume] = volumeName
+			dVolume.Labels[docker.LabelVersion] = docker.SupervisorVersion
 			outputVolumes = append(outputVolumes, dVolume)
 		}
 	}
 	return outputVolumes
 }
 
-func extractConfig(rawData map[interface{}]interface{}) {
+// Network and ipc modes may share the namespace of another service, which
+// refers to the container of that service
+func resolveServiceModes(targetService *docker.Service, projectName string) {
+	resolve := func(mode string) string {
+		if strings.HasPrefix(mode, "service:") {
+			return "container:" + projectName + "_" + strings.TrimPrefix(mode, "service:")
+		}
+		return mode
+	}
+	targetService.NetworkMode = resolve(targetService.NetworkMode)
+	targetService.IpcMode = resolve(targetService.IpcMode)
+}
+
+// Networks of services refer to the top-level networks section, so replace
+// their name with the name of the docker network
+func resolveServiceNetworks(targetService *docker.Service, networks docker.Networks, logger *zap.Logger) {
+	for idx, serviceNetwork := range targetService.Networks {
+		found := false
+		for _, network := range networks {
+			if network.Name == serviceNetwork.Name {
+				targetService.Networks[idx].Name = network.NetworkName
+				found = true
+				break
+			}
+		}
+		if !found {
+			logger.Error(fmt.Sprintf("Service %s refers to undefined network %s", targetService.Name, serviceNetwork.Name))
+		}
+	}
+}
 
+// Named volumes of services refer to the top-level volumes section, so replace
+// their source with the name of the docker volume
+func resolveServiceVolumes(targetService *docker.Service, volumes docker.Volumes, logger *zap.Logger) {
+	for idx, serviceVolume := range targetService.Volumes {
+		if serviceVolume.Type != docker.VolumeTypeVolume || serviceVolume.Source == "" {
+			continue
+		}
+		found := false
+		for _, volume := range volumes {
+			if volume.Name == serviceVolume.Source {
+				targetService.Volumes[idx].Source = volume.VolumeName
+				found = true
+				break
+			}
+		}
+		if !found {
+			logger.Error(fmt.Sprintf("Service %s refers to undefined volume %s", targetService.Name, serviceVolume.Source))
+		}
+	}
 }
 
-func extractSecrets(rawData map[interface{}]interface{}) {
+func extractConfigs(rawData map[interface{}]interface{}, projectPath string, environment map[string]string, logger *zap.Logger) docker.Configs {
+	logger.Debug("Extracting configs")
+	return extractFileObjects(rawData["configs"], projectPath, environment, logger)
+}
 
+func extractSecrets(rawData map[interface{}]interface{}, projectPath string, environment map[string]string, logger *zap.Logger) docker.Secrets {
+	logger.Debug("Extracting secrets")
+	return extractFileObjects(rawData["secrets"], projectPath, environment, logger)
 }
 
-func DisplayProject(project *Project) {
+// Log the project at debug level. Only the names of the environment variables
+// are logged as their values may be secrets
+func DisplayProject(project *Project, logger *zap.Logger) {
 	for _, service := range project.Services {
-		fmt.Printf("Service Name: %s\n", service.Name)
-		fmt.Printf("Build Context: %s\n", service.BuildOpt.Context)
-		fmt.Printf("Build Dockerfile: %s\n", service.BuildOpt.Dockerfile)
-		fmt.Printf("Build ContainerName: %s\n", service.ContainerName)
-		fmt.Printf("Depends On: %s\n", service.DependsOn)
-		fmt.Printf("Networks Name: %s\n", service.Networks[0].Name)
-		fmt.Printf("IPV4: %s\n", service.Networks[0].IPv4)
+		logger.Debug(fmt.Sprintf("Service Name: %s", service.Name))
+		logger.Debug(fmt.Sprintf("Build Context: %s", service.BuildOpt.Context))
+		logger.Debug(fmt.Sprintf("Build Dockerfile: %s", service.BuildOpt.Dockerfile))
+		logger.Debug(fmt.Sprintf("Build ContainerName: %s", service.ContainerName))
+		for _, dependency := range service.DependsOn {
+			logger.Debug(fmt.Sprintf("Depends On: %s (%s)", dependency.Name, dependency.Condition))
+		}
+		for _, network := range service.Networks {
+			logger.Debug(fmt.Sprintf("Networks Name: %s", network.Name))
+			logger.Debug(fmt.Sprintf("IPV4: %s", network.IPv4))
+		}
 		for _, env := range service.Environment {
-			fmt.Printf("Env: %s\n", env)
+			logger.Debug(fmt.Sprintf("Env: %s", strings.SplitN(env, "=", 2)[0]))
 		}
-		fmt.Printf("Image ID: %s\n", service.Image.ID)
-		fmt.Printf("Container ID: %s\n", service.Container.ID)
-		fmt.Printf("=====\n")
+		logger.Debug(fmt.Sprintf("Image ID: %s", service.Image.ID))
+		logger.Debug(fmt.Sprintf("Container ID: %s", service.Container.ID))
 	}
 
 	for _, networks := range project.Networks {
-		fmt.Printf("Network Name: %s\n", networks.Name)
-		fmt.Printf("Network Driver: %s\n", networks.Driver)
-		fmt.Printf("Network IPAM Subnet: %s\n", networks.Ipam.Config[0].Subnet)
-		fmt.Printf("Network IPAM Gateway: %s\n", networks.Ipam.Config[0].Gateway)
-		fmt.Printf("=====\n")
+		logger.Debug(fmt.Sprintf("Network Name: %s", networks.Name))
+		logger.Debug(fmt.Sprintf("Network External: %t", networks.External))
+		logger.Debug(fmt.Sprintf("Network Driver: %s", networks.Driver))
+		for _, config := range networks.Ipam.Config {
+			logger.Debug(fmt.Sprintf("Network IPAM Subnet: %s", config.Subnet))
+			logger.Debug(fmt.Sprintf("Network IPAM Gateway: %s", config.Gateway))
+		}
 	}
 
 	for _, volume := range project.Volumes {
-		fmt.Printf("Volume Name: %s\n", volume.Name)
+		logger.Debug(fmt.Sprintf("Volume Name: %s", volume.Name))
 	}
 }
@@ -0,0 +1,131 @@
+package compose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Build or pull the image of a service depending on its pull policy. Services
+// with a build section are rebuilt by default, while image only services are
+// pulled only when the image is missing
+func PrepareServiceImage(ctx context.Context, dockerClient *client.Client, projectName string, targetService *docker.Service, logger *zap.Logger) error {
+	pullPolicy := targetService.PullPolicy
+	if pullPolicy == "" {
+		if targetService.HasBuild() {
+			pullPolicy = docker.PullPolicyBuild
+		} else {
+			pullPolicy = docker.PullPolicyMissing
+		}
+	}
+	if targetService.HasBuild() {
+		setDefaultImageName(projectName, targetService)
+	}
+	if targetService.Image.Name == "" {
+		return errors.Errorf("service %s has neither an image nor a build section", targetService.Name)
+	}
+
+	switch pullPolicy {
+	case docker.PullPolicyNever:
+		exists, err := ImageExists(ctx, dockerClient, targetService, logger)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.Errorf("image %s of service %s is not present locally and pull policy is never", targetService.Image.Reference(), targetService.Name)
+		}
+		return nil
+	case docker.PullPolicyMissing:
+		exists, err := ImageExists(ctx, dockerClient, targetService, logger)
+		if err != nil {
+			return err
+		}
+		if exists {
+			logger.Info(fmt.Sprintf("Image %s of service %s is present locally", targetService.Image.Reference(), targetService.Name))
+			return nil
+		}
+		if targetService.HasBuild() {
+			_, err = BuildSingle(ctx, dockerClient, projectName, targetService, logger)
+			return err
+		}
+		return PullSingle(ctx, dockerClient, targetService, logger)
+	case docker.PullPolicyAlways:
+		err := PullSingle(ctx, dockerClient, targetService, logger)
+		if err != nil && targetService.HasBuild() {
+			logger.Warn(fmt.Sprintf("Unable to pull image of service %s, building it instead", targetService.Name))
+			_, err = BuildSingle(ctx, dockerClient, projectName, targetService, logger)
+		}
+		return err
+	case docker.PullPolicyBuild:
+		if !targetService.HasBuild() {
+			return errors.Errorf("service %s has pull policy build but no build section", targetService.Name)
+		}
+		_, err := BuildSingle(ctx, dockerClient, projectName, targetService, logger)
+		return err
+	default:
+		return errors.Errorf("unsupported pull policy %s for service %s", pullPolicy, targetService.Name)
+	}
+}
+
+func PullSingle(ctx context.Context, dockerClient *client.Client, targetService *docker.Service, logger *zap.Logger) error {
+	imageRef := targetService.Image.Reference()
+	logger.Info(fmt.Sprintf("Pulling image %s for service %s", imageRef, targetService.Name))
+
+	response, err := dockerClient.ImagePull(ctx, imageRef, types.ImagePullOptions{})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to pull image %s with error: %s", imageRef, err))
+		return err
+	}
+	defer response.Close()
+
+	decoder := json.NewDecoder(response)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			logger.Error(fmt.Sprintf("Unable to decode pull progress of image %s with error: %s", imageRef, err))
+			return err
+		}
+		if msg.Error != nil {
+			logger.Error(fmt.Sprintf("Unable to pull image %s with error: %s", imageRef, msg.Error.Message))
+			return msg.Error
+		}
+		// Skip the download and extract progress bars, only log changes of status
+		if msg.Progress != nil {
+			continue
+		}
+		if msg.ID != "" {
+			logger.Info(fmt.Sprintf("%s: %s: %s", imageRef, msg.ID, msg.Status))
+		} else {
+			logger.Info(fmt.Sprintf("%s: %s", imageRef, msg.Status))
+		}
+	}
+
+	_, err = ImageExists(ctx, dockerClient, targetService, logger)
+	return err
+}
+
+// Check whether the image of a service is present locally and attach its ID
+// to the service if it is
+func ImageExists(ctx context.Context, dockerClient *client.Client, targetService *docker.Service, logger *zap.Logger) (bool, error) {
+	info, _, err := dockerClient.ImageInspectWithRaw(ctx, targetService.Image.Reference())
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		logger.Error(fmt.Sprintf("Unable to inspect image %s with error: %s", targetService.Image.Reference(), err))
+		return false, err
+	}
+	targetService.Image.ID = info.ID
+	return true, nil
+}
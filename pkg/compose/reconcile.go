@@ -0,0 +1,267 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Actions taken by the reconciler on a service
+const (
+	ReconcileCreate   = "create"
+	ReconcileRecreate = "recreate"
+	ReconcileStart    = "start"
+	ReconcileKeep     = "keep"
+	ReconcileRemove   = "remove"
+)
+
+// ReconcileAction is the action needed to bring a service to its desired
+// state. Containers lists the containers of the service that currently exist
+type ReconcileAction struct {
+	Service    string
+	Action     string
+	Reason     string
+	Containers []string
+}
+
+// Compare the desired project with the containers of the project that exist.
+// Services without a container are created, services whose config hash or
+// image changed are recreated, stopped services are started and containers of
+// services that are no longer desired are removed. Services are listed in the
+// order they are started, orphans last
+func PlanReconcile(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) ([]ReconcileAction, error) {
+	projectContainers, err := ListProjectContainers(ctx, dockerClient, project.Name, logger)
+	if err != nil {
+		return nil, err
+	}
+	containersByService := map[string][]types.Container{}
+	for _, cnt := range projectContainers {
+		serviceName := cnt.Labels[docker.LabelService]
+		containersByService[serviceName] = append(containersByService[serviceName], cnt)
+	}
+
+	actions := []ReconcileAction{}
+	desired := map[string]bool{}
+	for _, targetService := range desiredServices(project) {
+		desired[targetService.Name] = true
+		if targetService.HasBuild() {
+			setDefaultImageName(project.Name, targetService)
+		}
+		actions = append(actions, planService(targetService, containersByService[targetService.Name]))
+	}
+
+	// Orphans are no longer in the project, so their dependencies are unknown.
+	// They are listed by name to keep the plan stable
+	orphans := []string{}
+	for serviceName := range containersByService {
+		if !desired[serviceName] {
+			orphans = append(orphans, serviceName)
+		}
+	}
+	sort.Strings(orphans)
+	for _, serviceName := range orphans {
+		containers := containersByService[serviceName]
+		action := ReconcileAction{
+			Service: serviceName,
+			Action:  ReconcileRemove,
+			Reason:  "service is no longer part of the project",
+		}
+		for _, cnt := range containers {
+			action.Containers = append(action.Containers, cnt.ID)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+func planService(targetService *docker.Service, containers []types.Container) ReconcileAction {
+	action := ReconcileAction{
+		Service: targetService.Name,
+	}
+	for _, cnt := range containers {
+		action.Containers = append(action.Containers, cnt.ID)
+	}
+
+	switch {
+	case len(containers) == 0:
+		action.Action = ReconcileCreate
+		action.Reason = "container does not exist"
+	case len(containers) > 1:
+		action.Action = ReconcileRecreate
+		action.Reason = "service has more than one container"
+	case containers[0].Labels[docker.LabelConfigHash] != ServiceConfigHash(targetService):
+		action.Action = ReconcileRecreate
+		action.Reason = "configuration has changed"
+	case targetService.Image.ID != "" && containers[0].ImageID != targetService.Image.ID:
+		action.Action = ReconcileRecreate
+		action.Reason = "image has changed"
+	case containers[0].State != "running":
+		action.Action = ReconcileStart
+		action.Reason = fmt.Sprintf("container is %s", containers[0].State)
+	default:
+		action.Action = ReconcileKeep
+		action.Reason = "container is up to date"
+	}
+	return action
+}
+
+// ReconcileResult is the outcome of the action taken on a service
+type ReconcileResult struct {
+	Service string
+	Action  string
+	Err     error
+}
+
+type ReconcileResults []ReconcileResult
+
+// Combined error of the services that could not be reconciled, nil if every
+// service reached its desired state
+func (results ReconcileResults) Err() error {
+	failed := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Service, result.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.Errorf("unable to reconcile %d services: %s", len(failed), strings.Join(failed, "; "))
+}
+
+// Bring the containers of the project to the state described by the project,
+// leaving the containers that are up to date untouched. Images are only built
+// or pulled for services that need a container and whose image is missing.
+// A service that fails does not stop the others, except those depending on
+// it, and every service gets a result
+func Reconcile(ctx context.Context, dockerClient *client.Client, project *Project, logger *zap.Logger) (ReconcileResults, error) {
+	if err := CreateNetwork(ctx, project, dockerClient, logger); err != nil {
+		logger.Error(fmt.Sprintf("Unable to create networks with error: %s", err))
+		return nil, err
+	}
+	if err := CreateVolume(ctx, project, dockerClient, logger); err != nil {
+		logger.Error(fmt.Sprintf("Unable to create volumes with error: %s", err))
+		return nil, err
+	}
+
+	// Image ids are needed to tell whether containers run the latest image
+	services := map[string]*docker.Service{}
+	for _, targetService := range desiredServices(project) {
+		services[targetService.Name] = targetService
+		if targetService.HasBuild() {
+			setDefaultImageName(project.Name, targetService)
+		}
+		if targetService.Image.ID == "" && targetService.Image.Name != "" {
+			if _, err := ImageExists(ctx, dockerClient, targetService, logger); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	actions, err := PlanReconcile(ctx, dockerClient, project, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Orphans are removed first so that they release their names, addresses
+	// and ports
+	results := ReconcileResults{}
+	for _, action := range actions {
+		if action.Action != ReconcileRemove {
+			continue
+		}
+		logger.Info(fmt.Sprintf("Removing service %s: %s", action.Service, action.Reason))
+		result := ReconcileResult{Service: action.Service, Action: action.Action}
+		for _, containerID := range action.Containers {
+			StopServiceByID(ctx, dockerClient, containerID, logger)
+			if err := RemoveServiceByID(ctx, dockerClient, containerID, logger); err != nil {
+				result.Err = err
+			}
+		}
+		results = append(results, result)
+	}
+
+	failed := map[string]bool{}
+	for _, action := range actions {
+		if action.Action == ReconcileRemove {
+			continue
+		}
+		result := ReconcileResult{Service: action.Service, Action: action.Action}
+		for _, dependency := range services[action.Service].DependsOn {
+			if failed[dependency.Name] {
+				result.Err = errors.Errorf("dependency %s could not be reconciled", dependency.Name)
+				break
+			}
+		}
+		if result.Err == nil {
+			logger.Info(fmt.Sprintf("Reconciling service %s: %s (%s)", action.Service, action.Action, action.Reason))
+			result.Err = applyReconcileAction(ctx, dockerClient, project, services[action.Service], action, logger)
+		}
+		if result.Err != nil {
+			logger.Error(fmt.Sprintf("Unable to %s service %s with error: %s", action.Action, action.Service, result.Err))
+			failed[action.Service] = true
+		}
+		results = append(results, result)
+	}
+
+	// Images replaced by the reconciliation are no longer in use
+	for _, targetService := range services {
+		if targetService.HasBuild() {
+			PruneImageHistory(ctx, dockerClient, project.Name, targetService, logger)
+		}
+	}
+	return results, results.Err()
+}
+
+func applyReconcileAction(ctx context.Context, dockerClient *client.Client, project *Project, targetService *docker.Service, action ReconcileAction, logger *zap.Logger) error {
+	if len(action.Containers) > 0 {
+		targetService.Container = docker.Container{
+			ID:   action.Containers[0],
+			Name: targetService.ContainerName,
+		}
+	}
+
+	switch action.Action {
+	case ReconcileKeep:
+		return nil
+	case ReconcileCreate, ReconcileRecreate:
+		if targetService.Image.ID == "" {
+			if err := PrepareServiceImage(ctx, dockerClient, project.Name, targetService, logger); err != nil {
+				return err
+			}
+		}
+		for _, containerID := range action.Containers {
+			StopServiceByID(ctx, dockerClient, containerID, logger)
+		}
+		if _, err := CreateSingleContainer(ctx, project.Name, targetService, project.Networks, dockerClient, logger); err != nil {
+			return err
+		}
+	}
+
+	if err := WaitForDependencies(ctx, dockerClient, project, targetService, logger); err != nil {
+		return err
+	}
+	return StartSingleServiceContainer(ctx, dockerClient, targetService, logger)
+}
+
+// Services that should be running: core followed by the enabled services in
+// the order they are started
+func desiredServices(project *Project) []*docker.Service {
+	services := []*docker.Service{}
+	if project.Core.Name != "" {
+		services = append(services, &project.Core)
+	}
+	for idx := range project.Services {
+		if project.IsServiceEnabled(&project.Services[idx]) {
+			services = append(services, &project.Services[idx])
+		}
+	}
+	return services
+}
@@ -0,0 +1,298 @@
+package compose
+
+import (
+	"github.com/dkhoanguyen/ros-supervisor/pkg/schema"
+)
+
+var (
+	stringSchema   = schema.Of(schema.String)
+	boolSchema     = schema.Of(schema.Bool)
+	intSchema      = schema.Of(schema.Int)
+	numberSchema   = schema.Of(schema.Number)
+	scalarSchema   = schema.Of(schema.Scalar)
+	nullSchema     = schema.Of(schema.Null)
+	anySchema      = schema.Of(schema.Any)
+	stringsSchema  = schema.ListOf(stringSchema)
+	scalarsSchema  = schema.ListOf(scalarSchema)
+	stringOrList   = schema.Either(stringSchema, stringsSchema)
+	listOrMapping  = schema.Either(scalarsSchema, schema.MapOf(schema.Either(scalarSchema, nullSchema)))
+	durationSchema = schema.Either(stringSchema, intSchema)
+	byteSizeSchema = schema.Either(stringSchema, intSchema)
+)
+
+var buildSchema = schema.Either(stringSchema, &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"context":     stringSchema,
+		"dockerfile":  stringSchema,
+		"args":        listOrMapping,
+		"target":      stringSchema,
+		"labels":      listOrMapping,
+		"cache_from":  stringsSchema,
+		"shm_size":    byteSizeSchema,
+		"network":     stringSchema,
+		"extra_hosts": listOrMapping,
+		"platforms":   stringsSchema,
+		"ssh":         anySchema,
+		"secrets":     anySchema,
+		"tags":        stringsSchema,
+	},
+})
+
+var healthCheckSchema = &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"test":         stringOrList,
+		"interval":     durationSchema,
+		"timeout":      durationSchema,
+		"start_period": durationSchema,
+		"retries":      intSchema,
+		"disable":      boolSchema,
+	},
+}
+
+var fileReferenceSchema = schema.ListOf(schema.Either(stringSchema, &schema.Schema{
+	Kind:     schema.Mapping,
+	Required: []string{"source"},
+	Fields: map[string]*schema.Schema{
+		"source": stringSchema,
+		"target": stringSchema,
+		"uid":    scalarSchema,
+		"gid":    scalarSchema,
+		"mode":   intSchema,
+	},
+}))
+
+var serviceSchema = &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"build":          buildSchema,
+		"image":          stringSchema,
+		"pull_policy":    schema.Enum("always", "missing", "never", "build", "if_not_present"),
+		"container_name": stringSchema,
+		"command":        schema.Either(stringSchema, scalarsSchema, nullSchema),
+		"entrypoint":     schema.Either(stringSchema, scalarsSchema, nullSchema),
+		"environment":    listOrMapping,
+		"env_file":       stringOrList,
+		"depends_on": schema.Either(stringsSchema, schema.MapOf(&schema.Schema{
+			Kind: schema.Mapping,
+			Fields: map[string]*schema.Schema{
+				"condition": schema.Enum("service_started", "service_healthy", "service_completed_successfully"),
+				"restart":   boolSchema,
+				"required":  boolSchema,
+			},
+		})),
+		"restart": stringSchema,
+		"networks": schema.Either(stringsSchema, schema.MapOf(schema.Either(nullSchema, &schema.Schema{
+			Kind:            schema.Mapping,
+			AllowExtensions: true,
+			Fields: map[string]*schema.Schema{
+				"aliases":        stringsSchema,
+				"ipv4_address":   stringSchema,
+				"ipv6_address":   stringSchema,
+				"priority":       intSchema,
+				"link_local_ips": stringsSchema,
+			},
+		}))),
+		"ports": schema.ListOf(schema.Either(stringSchema, intSchema, &schema.Schema{
+			Kind:     schema.Mapping,
+			Required: []string{"target"},
+			Fields: map[string]*schema.Schema{
+				"target":    intSchema,
+				"published": scalarSchema,
+				"host_ip":   stringSchema,
+				"protocol":  stringSchema,
+				"mode":      stringSchema,
+			},
+		})),
+		"expose": scalarsSchema,
+		"volumes": schema.ListOf(schema.Either(stringSchema, &schema.Schema{
+			Kind:            schema.Mapping,
+			AllowExtensions: true,
+			Required:        []string{"type", "target"},
+			Fields: map[string]*schema.Schema{
+				"type":        schema.Enum("bind", "volume", "tmpfs"),
+				"source":      stringSchema,
+				"target":      stringSchema,
+				"read_only":   boolSchema,
+				"consistency": stringSchema,
+				"bind": &schema.Schema{
+					Kind: schema.Mapping,
+					Fields: map[string]*schema.Schema{
+						"propagation":      stringSchema,
+						"create_host_path": boolSchema,
+					},
+				},
+				"volume": &schema.Schema{
+					Kind: schema.Mapping,
+					Fields: map[string]*schema.Schema{
+						"nocopy": boolSchema,
+					},
+				},
+				"tmpfs": &schema.Schema{
+					Kind: schema.Mapping,
+					Fields: map[string]*schema.Schema{
+						"size": byteSizeSchema,
+						"mode": intSchema,
+					},
+				},
+			},
+		})),
+		"tmpfs":       stringOrList,
+		"healthcheck": healthCheckSchema,
+		"profiles":    stringsSchema,
+		"secrets":     fileReferenceSchema,
+		"configs":     fileReferenceSchema,
+
+		"mem_limit":        byteSizeSchema,
+		"memswap_limit":    byteSizeSchema,
+		"mem_reservation":  byteSizeSchema,
+		"shm_size":         byteSizeSchema,
+		"cpus":             schema.Either(numberSchema, stringSchema),
+		"cpuset":           stringSchema,
+		"cpu_shares":       intSchema,
+		"cpu_quota":        durationSchema,
+		"cpu_period":       durationSchema,
+		"cpu_rt_runtime":   durationSchema,
+		"cpu_rt_period":    durationSchema,
+		"pids_limit":       intSchema,
+		"oom_kill_disable": boolSchema,
+		"ulimits": schema.MapOf(schema.Either(intSchema, &schema.Schema{
+			Kind:     schema.Mapping,
+			Required: []string{"soft", "hard"},
+			Fields: map[string]*schema.Schema{
+				"soft": intSchema,
+				"hard": intSchema,
+			},
+		})),
+		"deploy": anySchema,
+
+		"user":          stringSchema,
+		"working_dir":   stringSchema,
+		"hostname":      stringSchema,
+		"domainname":    stringSchema,
+		"tty":           boolSchema,
+		"stdin_open":    boolSchema,
+		"privileged":    boolSchema,
+		"cap_add":       stringsSchema,
+		"cap_drop":      stringsSchema,
+		"devices":       stringsSchema,
+		"network_mode":  stringSchema,
+		"ipc":           stringSchema,
+		"sysctls":       listOrMapping,
+		"cgroup_parent": stringSchema,
+
+		"extends": schema.Either(stringSchema, &schema.Schema{
+			Kind:     schema.Mapping,
+			Required: []string{"service"},
+			Fields: map[string]*schema.Schema{
+				"service": stringSchema,
+				"file":    stringSchema,
+			},
+		}),
+
+		"logging": &schema.Schema{
+			Kind: schema.Mapping,
+			Fields: map[string]*schema.Schema{
+				"driver":  stringSchema,
+				"options": schema.MapOf(schema.Either(scalarSchema, nullSchema)),
+			},
+		},
+		"stop_signal":       stringSchema,
+		"stop_grace_period": durationSchema,
+		"init":              boolSchema,
+
+		// Keys of the compose specification which are accepted but not
+		// handled by the supervisor
+		"labels":         listOrMapping,
+		"extra_hosts":    listOrMapping,
+		"dns":            stringOrList,
+		"dns_search":     stringOrList,
+		"security_opt":   stringsSchema,
+		"group_add":      scalarsSchema,
+		"read_only":      boolSchema,
+		"pid":            schema.Either(stringSchema, nullSchema),
+		"platform":       stringSchema,
+		"runtime":        stringSchema,
+		"links":          stringsSchema,
+		"external_links": stringsSchema,
+		"volumes_from":   stringsSchema,
+		"userns_mode":    stringSchema,
+		"scale":          intSchema,
+		"mac_address":    stringSchema,
+	},
+}
+
+var networkSchema = schema.Either(nullSchema, &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"name":        stringSchema,
+		"driver":      stringSchema,
+		"driver_opts": schema.MapOf(scalarSchema),
+		"external":    boolSchema,
+		"internal":    boolSchema,
+		"attachable":  boolSchema,
+		"enable_ipv6": boolSchema,
+		"labels":      listOrMapping,
+		"ipam": &schema.Schema{
+			Kind: schema.Mapping,
+			Fields: map[string]*schema.Schema{
+				"driver": stringSchema,
+				"config": schema.ListOf(&schema.Schema{
+					Kind: schema.Mapping,
+					Fields: map[string]*schema.Schema{
+						"subnet":        stringSchema,
+						"gateway":       stringSchema,
+						"ip_range":      stringSchema,
+						"aux_addresses": schema.MapOf(stringSchema),
+					},
+				}),
+				"options": schema.MapOf(stringSchema),
+			},
+		},
+	},
+})
+
+var volumeSchema = schema.Either(nullSchema, &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"name":        stringSchema,
+		"driver":      stringSchema,
+		"driver_opts": schema.MapOf(scalarSchema),
+		"external":    boolSchema,
+		"labels":      listOrMapping,
+	},
+})
+
+var fileObjectSchema = &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"name":        stringSchema,
+		"file":        stringSchema,
+		"environment": stringSchema,
+		"content":     stringSchema,
+		"external":    boolSchema,
+	},
+}
+
+// ComposeSchema describes the subset of the compose specification understood
+// by the supervisor
+var ComposeSchema = &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*schema.Schema{
+		"version":  scalarSchema,
+		"name":     stringSchema,
+		"services": schema.MapOf(serviceSchema),
+		"networks": schema.MapOf(networkSchema),
+		"volumes":  schema.MapOf(volumeSchema),
+		"configs":  schema.MapOf(fileObjectSchema),
+		"secrets":  schema.MapOf(fileObjectSchema),
+	},
+}
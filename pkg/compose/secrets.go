@@ -0,0 +1,274 @@
+package compose
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Extract the top-level configs or secrets section. Variables are taken from
+// the project environment, as for interpolation. Contents are never logged as
+// secrets may be inlined
+func extractFileObjects(rawObjects interface{}, projectPath string, environment map[string]string, logger *zap.Logger) docker.Configs {
+	outputObjects := docker.Configs{}
+	objects, ok := rawObjects.(map[string]interface{})
+	if !ok {
+		return outputObjects
+	}
+	for name, rawObject := range objects {
+		dObject := docker.Config{
+			Name: name,
+		}
+		objectOpt, ok := rawObject.(map[string]interface{})
+		if !ok {
+			logger.Error(fmt.Sprintf("Definition of %s has no source", name))
+			continue
+		}
+		sources := 0
+		if file, ok := objectOpt["file"].(string); ok {
+			dObject.File = resolveHostPath(file, projectPath)
+			sources++
+		}
+		if variable, ok := objectOpt["environment"].(string); ok {
+			dObject.Environment = variable
+			if value, ok := environment[variable]; ok {
+				dObject.Value = &value
+			}
+			sources++
+		}
+		if content, ok := objectOpt["content"].(string); ok {
+			dObject.Content = content
+			sources++
+		}
+		if sources != 1 {
+			logger.Error(fmt.Sprintf("Definition of %s must have exactly one of file, environment or content", name))
+			continue
+		}
+		outputObjects = append(outputObjects, dObject)
+	}
+	sort.Slice(outputObjects, func(i, j int) bool {
+		return outputObjects[i].Name < outputObjects[j].Name
+	})
+	return outputObjects
+}
+
+// Extract the configs or secrets granted to a service, written either as the
+// name of the definition or with source, target, uid, gid and mode. Relative
+// targets are placed in the default directory
+func extractServiceFileReferences(rawReferences []interface{}, defaultDir string, defaultMode uint32) ([]docker.ServiceFileReference, error) {
+	references := []docker.ServiceFileReference{}
+	for _, rawReference := range rawReferences {
+		reference := docker.ServiceFileReference{
+			Mode: defaultMode,
+		}
+		switch referenceOpt := rawReference.(type) {
+		case string:
+			reference.Source = referenceOpt
+		case map[string]interface{}:
+			source, ok := referenceOpt["source"].(string)
+			if !ok {
+				return references, errors.New("missing source")
+			}
+			reference.Source = source
+			if target, ok := referenceOpt["target"].(string); ok {
+				reference.Target = target
+			}
+			if uid, ok := referenceOpt["uid"]; ok {
+				reference.UID = toString(uid)
+			}
+			if gid, ok := referenceOpt["gid"]; ok {
+				reference.GID = toString(gid)
+			}
+			if mode, ok := referenceOpt["mode"].(int); ok {
+				reference.Mode = uint32(mode)
+			}
+		default:
+			return references, errors.Errorf("unsupported format %v", rawReference)
+		}
+
+		if reference.Target == "" {
+			reference.Target = reference.Source
+		}
+		if !path.IsAbs(reference.Target) {
+			reference.Target = path.Join(defaultDir, reference.Target)
+		}
+		references = append(references, reference)
+	}
+	return references, nil
+}
+
+// Attach the top-level definitions to the configs and secrets of a service
+func resolveServiceFileReferences(targetService *docker.Service, configs docker.Configs, secrets docker.Secrets, logger *zap.Logger) {
+	resolve := func(references []docker.ServiceFileReference, definitions docker.Configs, kind string) {
+		for idx, reference := range references {
+			found := false
+			for _, definition := range definitions {
+				if definition.Name == reference.Source {
+					references[idx].Definition = definition
+					found = true
+					break
+				}
+			}
+			if !found {
+				logger.Error(fmt.Sprintf("Service %s refers to undefined %s %s", targetService.Name, kind, reference.Source))
+			}
+		}
+	}
+	resolve(targetService.Configs, configs, "config")
+	resolve(targetService.Secrets, secrets, "secret")
+}
+
+// Read the content of a config or secret from its source
+func readFileObject(definition docker.Config) ([]byte, error) {
+	switch {
+	case definition.File != "":
+		return ioutil.ReadFile(definition.File)
+	case definition.Environment != "":
+		if definition.Value == nil {
+			return nil, errors.Errorf("environment variable %s is not set", definition.Environment)
+		}
+		return []byte(*definition.Value), nil
+	case definition.Content != "":
+		return []byte(definition.Content), nil
+	default:
+		return nil, errors.Errorf("%s is undefined", definition.Name)
+	}
+}
+
+// Directory the secrets of the services are written to, which should be on a
+// tmpfs such as /run so that they never reach the disk
+var SecretsDir = "/run/ros-supervisor/secrets"
+
+// The same directory as seen by the docker daemon, when the supervisor runs in
+// a container. SecretsDir is used when it is empty
+var SecretsHostDir = ""
+
+// Write the secrets of a service to SecretsDir and return the read-only bind
+// mounts exposing them in its container. Secrets are not copied into the
+// container, where they would be kept in its writable layer
+func WriteServiceSecrets(projectName string, targetService *docker.Service, logger *zap.Logger) ([]mount.Mount, error) {
+	serviceDir := projectName + "_" + targetService.Name
+	if err := os.RemoveAll(filepath.Join(SecretsDir, serviceDir)); err != nil {
+		return nil, err
+	}
+	if len(targetService.Secrets) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Join(SecretsDir, serviceDir), 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create secrets directory")
+	}
+	hostDir := SecretsHostDir
+	if hostDir == "" {
+		hostDir = SecretsDir
+	}
+
+	mounts := []mount.Mount{}
+	for _, reference := range targetService.Secrets {
+		content, err := readFileObject(reference.Definition)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to read secret %s for service %s with error: %s", reference.Source, targetService.Name, err))
+			return nil, err
+		}
+		secretPath := filepath.Join(SecretsDir, serviceDir, reference.Source)
+		if err := ioutil.WriteFile(secretPath, content, os.FileMode(reference.Mode)); err != nil {
+			return nil, errors.Wrapf(err, "unable to write secret %s", reference.Source)
+		}
+		// The mode given by WriteFile is masked by the umask
+		if err := os.Chmod(secretPath, os.FileMode(reference.Mode)); err != nil {
+			return nil, err
+		}
+		uid, gid := -1, -1
+		if reference.UID != "" {
+			if uid, err = strconv.Atoi(reference.UID); err != nil {
+				return nil, errors.Errorf("invalid uid %s for %s", reference.UID, reference.Source)
+			}
+		}
+		if reference.GID != "" {
+			if gid, err = strconv.Atoi(reference.GID); err != nil {
+				return nil, errors.Errorf("invalid gid %s for %s", reference.GID, reference.Source)
+			}
+		}
+		if uid >= 0 || gid >= 0 {
+			if err := os.Chown(secretPath, uid, gid); err != nil {
+				return nil, errors.Wrapf(err, "unable to change owner of secret %s", reference.Source)
+			}
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   filepath.Join(hostDir, serviceDir, reference.Source),
+			Target:   reference.Target,
+			ReadOnly: true,
+		})
+	}
+	return mounts, nil
+}
+
+// Copy the configs of a service into its container before it is started.
+// Configs are copied rather than bind mounted so that the project directory
+// does not have to be visible to the docker daemon
+func CopyServiceFiles(ctx context.Context, dockerClient *client.Client, targetService *docker.Service, logger *zap.Logger) error {
+	references := targetService.Configs
+	if len(references) == 0 {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	for _, reference := range references {
+		content, err := readFileObject(reference.Definition)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to read %s for service %s with error: %s", reference.Source, targetService.Name, err))
+			return err
+		}
+		header := &tar.Header{
+			Name:    strings.TrimPrefix(reference.Target, "/"),
+			Mode:    int64(reference.Mode),
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if reference.UID != "" {
+			if header.Uid, err = strconv.Atoi(reference.UID); err != nil {
+				return errors.Errorf("invalid uid %s for %s", reference.UID, reference.Source)
+			}
+		}
+		if reference.GID != "" {
+			if header.Gid, err = strconv.Atoi(reference.GID); err != nil {
+				return errors.Errorf("invalid gid %s for %s", reference.GID, reference.Source)
+			}
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	err := dockerClient.CopyToContainer(ctx, targetService.Container.ID, "/", &buffer, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to copy configs into container %s with error: %s", targetService.Container.Name, err))
+		return err
+	}
+	return nil
+}
@@ -9,19 +9,11 @@ import (
 	"go.uber.org/zap"
 )
 
-func StopServices(ctx context.Context, dockerClient *client.Client, project *Project) error {
-	for idx := range project.Services {
-		err := StopService(ctx, dockerClient, &project.Services[idx])
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
+// Stop the container of a service with its stop signal, killing it once the
+// grace period of the service is over
 func StopService(ctx context.Context, dockerClient *client.Client, targetService *docker.Service) error {
 	containerID := targetService.Container.ID
-	return dockerClient.ContainerStop(ctx, containerID, nil)
+	return dockerClient.ContainerStop(ctx, containerID, targetService.StopGracePeriod)
 }
 
 func StopServiceByID(ctx context.Context, dockerClient *client.Client, containerID string, logger *zap.Logger) error {
@@ -1 +1,179 @@
 package compose
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Time an updated service without healthcheck must keep running before the
+// update is considered successful
+var UpdateStabilizationPeriod = 10 * time.Second
+
+// Maximum time an updated service has to become ready before it is rolled
+// back
+var UpdateReadyTimeout = 5 * time.Minute
+
+// Tag keeping the image of a service that is being updated, so that it is
+// not pruned before the update succeeds
+const RollbackTag = "rollback"
+
+// Update a service from its current configuration to the one of
+// targetService. The running container is only replaced once the new image is
+// built, and the current image and configuration are restored if the new
+// container fails to start or to become healthy
+func UpdateService(ctx context.Context, dockerClient *client.Client, project *Project, current docker.Service, targetService *docker.Service, logger *zap.Logger) error {
+	if targetService.HasBuild() {
+		setDefaultImageName(project.Name, targetService)
+		setDefaultImageName(project.Name, &current)
+	}
+	// The service is left as it was whenever the update stops before its
+	// container is replaced
+	original := current
+	previous := current
+	exists, err := ImageExists(ctx, dockerClient, &previous, logger)
+	if err != nil {
+		return err
+	}
+	if exists {
+		rollbackRef := previous.Image.Name + ":" + RollbackTag
+		if err := dockerClient.ImageTag(ctx, previous.Image.ID, rollbackRef); err != nil {
+			logger.Warn(fmt.Sprintf("Unable to keep previous image of service %s with error: %s", targetService.Name, err))
+		}
+	} else {
+		previous.Image.ID = ""
+	}
+
+	// The running container is left untouched if the build fails
+	targetService.Image.ID = ""
+	if targetService.HasBuild() {
+		_, err = BuildSingle(ctx, dockerClient, project.Name, targetService, logger)
+	} else {
+		err = PrepareServiceImage(ctx, dockerClient, project.Name, targetService, logger)
+	}
+	if err != nil {
+		restoreImageTag(ctx, dockerClient, previous, logger)
+		*targetService = original
+		return errors.Wrapf(err, "unable to build service %s", targetService.Name)
+	}
+	if _, err := ImageExists(ctx, dockerClient, targetService, logger); err != nil {
+		restoreImageTag(ctx, dockerClient, previous, logger)
+		*targetService = original
+		return err
+	}
+
+	// The previous container keeps running until the dependencies of the
+	// updated service are ready
+	if err := WaitForDependencies(ctx, dockerClient, project, targetService, logger); err != nil {
+		restoreImageTag(ctx, dockerClient, previous, logger)
+		*targetService = original
+		return err
+	}
+	if previous.Container.ID != "" {
+		logger.Info(fmt.Sprintf("Stopping previous container of service %s", targetService.Name))
+		StopService(ctx, dockerClient, &previous)
+	}
+	err = startUpdatedService(ctx, dockerClient, project, targetService, logger)
+	if err == nil {
+		logger.Info(fmt.Sprintf("Service %s updated to image %s", targetService.Name, targetService.Image.ID))
+		if targetService.HasBuild() {
+			PruneImageHistory(ctx, dockerClient, project.Name, targetService, logger)
+		}
+		return nil
+	}
+
+	logger.Error(fmt.Sprintf("Updated service %s failed with error: %s. Rolling back", targetService.Name, err))
+	if rollbackErr := rollbackService(ctx, dockerClient, project, targetService, previous, logger); rollbackErr != nil {
+		return errors.Wrapf(err, "rollback failed with error: %s", rollbackErr)
+	}
+	return errors.Wrap(err, "service was rolled back")
+}
+
+func startUpdatedService(ctx context.Context, dockerClient *client.Client, project *Project, targetService *docker.Service, logger *zap.Logger) error {
+	if _, err := CreateSingleContainer(ctx, project.Name, targetService, project.Networks, dockerClient, logger); err != nil {
+		return err
+	}
+	if err := StartSingleServiceContainer(ctx, dockerClient, targetService, logger); err != nil {
+		return err
+	}
+	return waitUntilReady(ctx, dockerClient, targetService, logger)
+}
+
+// Point the image reference of the service back to the previous image and
+// recreate the previous container, so that the reconciler sees the rolled
+// back service as up to date
+func rollbackService(ctx context.Context, dockerClient *client.Client, project *Project, targetService *docker.Service, previous docker.Service, logger *zap.Logger) error {
+	if previous.Image.ID == "" {
+		return errors.New("no previous image to roll back to")
+	}
+	if err := restoreImageTag(ctx, dockerClient, previous, logger); err != nil {
+		return err
+	}
+	if targetService.Container.ID != "" {
+		StopService(ctx, dockerClient, targetService)
+	}
+	*targetService = previous
+	if _, err := CreateSingleContainer(ctx, project.Name, targetService, project.Networks, dockerClient, logger); err != nil {
+		return err
+	}
+	if err := StartSingleServiceContainer(ctx, dockerClient, targetService, logger); err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Service %s rolled back to image %s", targetService.Name, previous.Image.ID))
+	return nil
+}
+
+// Point the image reference of the service back to its previous image, which
+// a build or a pull of the update moved to the new image. Images referenced by
+// digest are left as they are
+func restoreImageTag(ctx context.Context, dockerClient *client.Client, previous docker.Service, logger *zap.Logger) error {
+	if previous.Image.ID == "" || previous.Image.Digest != "" {
+		return nil
+	}
+	if err := dockerClient.ImageTag(ctx, previous.Image.ID, previous.Image.Reference()); err != nil {
+		logger.Error(fmt.Sprintf("Unable to restore image %s of service %s with error: %s", previous.Image.Reference(), previous.Name, err))
+		return err
+	}
+	return nil
+}
+
+// Wait until the container is healthy. Containers without healthcheck are
+// ready once they kept running for the stabilization period
+func waitUntilReady(ctx context.Context, dockerClient *client.Client, targetService *docker.Service, logger *zap.Logger) error {
+	waitCtx, cancel := context.WithTimeout(ctx, UpdateReadyTimeout)
+	defer cancel()
+
+	stableAt := time.Now().Add(UpdateStabilizationPeriod)
+	for {
+		state, err := InspectServiceState(waitCtx, targetService, dockerClient, logger)
+		if err != nil {
+			return err
+		}
+		switch state.Status {
+		case "exited", "dead", "restarting":
+			return errors.Errorf("container is %s", state.Status)
+		}
+		switch state.Health {
+		case types.Healthy:
+			return nil
+		case types.Unhealthy:
+			return errors.New("container is unhealthy")
+		case types.NoHealthcheck:
+			if state.Status == "running" && time.Now().After(stableAt) {
+				return nil
+			}
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return errors.New("timed out waiting for the container to become ready")
+		case <-time.After(dependencyPollInterval):
+		}
+	}
+}
@@ -2,3 +2,26 @@ package docker
 
 type ShellCommand []string
 type Labels map[string]string
+
+// Labels stamped on the containers, networks, volumes and images created by
+// the supervisor, which are used to find them again
+const (
+	LabelProject    = "ros-supervisor.project"
+	LabelService    = "ros-supervisor.service"
+	LabelVolume     = "ros-supervisor.volume"
+	LabelNetwork    = "ros-supervisor.network"
+	LabelConfigHash = "ros-supervisor.config-hash"
+	LabelCommit     = "ros-supervisor.commit"
+	LabelVersion    = "ros-supervisor.version"
+)
+
+// Annotations of the OCI image spec stamped on built images
+const (
+	LabelOCIRevision = "org.opencontainers.image.revision"
+	LabelOCITitle    = "org.opencontainers.image.title"
+	LabelOCIVersion  = "org.opencontainers.image.version"
+)
+
+// Version of the supervisor, set at build time with
+// -ldflags "-X github.com/dkhoanguyen/ros-supervisor/pkg/docker.SupervisorVersion=<version>"
+var SupervisorVersion = "dev"
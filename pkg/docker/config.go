@@ -2,5 +2,33 @@ package docker
 
 type Configs []Config
 
+// Config is the top-level definition of a config or a secret. Its content
+// comes from a file, a variable of the project environment or is inlined
 type Config struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	Environment string `json:"environment"`
+	Content     string `json:"-" yaml:"-"`
+	// Value of the environment variable when the project was loaded, nil if
+	// it is not set
+	Value *string `json:"-" yaml:"-"`
 }
+
+// Secrets are defined the same way as configs
+type Secrets = Configs
+
+// ServiceFileReference grants a service access to a config or a secret
+type ServiceFileReference struct {
+	Source     string
+	Target     string
+	UID        string
+	GID        string
+	Mode       uint32
+	Definition Config `json:"-" yaml:"-"`
+}
+
+const (
+	DefaultSecretsDir = "/run/secrets"
+	DefaultFileMode   = 0444
+	DefaultSecretMode = 0400
+)
@@ -1,6 +1,10 @@
 package docker
 
-import "github.com/docker/docker/api/types/container"
+import (
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
 
 type Container struct {
 	Name string `json:"name"`
@@ -34,6 +38,18 @@ type ContainerConfig struct {
 }
 
 type HeathCheckConfig struct {
+	Test        []string
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+	Disable     bool
+}
+
+// State of a container together with the result of its healthcheck
+type ContainerState struct {
+	Status string `json:"status"`
+	Health string `json:"health"`
 }
 
 type HostConfig struct {
@@ -4,9 +4,21 @@ type Image struct {
 	ID      string
 	Name    string
 	Tag     string
+	Digest  string
 	Created string
 }
 
+// Reference returns the image reference used to create containers
+func (image Image) Reference() string {
+	if image.Digest != "" {
+		return image.Name + "@" + image.Digest
+	}
+	if image.Tag != "" {
+		return image.Name + ":" + image.Tag
+	}
+	return image.Name
+}
+
 type ImageContainerConfig struct {
 	HostName   string `json:"hostName"`
 	DomainName string `json:"domainName"`
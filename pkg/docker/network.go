@@ -6,6 +6,7 @@ type Networks []Network
 
 type Network struct {
 	Name           string `json:"name"`
+	NetworkName    string `json:"network_name"`
 	ID             string
 	CheckDuplicate bool
 	Labels         Labels
@@ -14,6 +15,9 @@ type Network struct {
 	Driver         string `json:"driver"`
 	Ipam           network.IPAM
 	EnableIPv6     bool
+	// External networks are managed outside of the project and are never
+	// created nor removed by the supervisor
+	External bool `json:"external"`
 }
 
 // IPAMConfig represents IPAM configuration
@@ -1,45 +1,105 @@
 package docker
 
+import "time"
+
 type Services []Service
 
 type Service struct {
-	Name           string
-	Hostname       string
-	User           string
-	CapAdd         []string
-	CapDrop        []string
-	BuildOpt       ServiceBuild
-	CgroupParent   string
-	Command        ShellCommand
+	Name         string
+	Hostname     string
+	User         string
+	CapAdd       []string
+	CapDrop      []string
+	BuildOpt     ServiceBuild
+	CgroupParent string
+	CPUs         float64
+	CPUSet       string
+	CPUShares    int64
+	CPUQuota     int64
+	CPUPeriod    int64
+	CPURTRuntime int64
+	CPURTPeriod  int64
+	Command      ShellCommand
+	// Commits of the repositories the service is built from, set by the
+	// supervisor before the service is deployed
+	Commit         string
+	Configs        []ServiceFileReference
 	ContainerName  string
 	Domainname     string
-	DependsOn      []string
+	DependsOn      []ServiceDependency
 	Devices        []string
+	DeviceRequests []ServiceDeviceRequest
 	EntryPoint     ShellCommand
 	Environment    []string
 	EnvFile        []string
 	Expose         []string
+	HealthCheck    *HeathCheckConfig
 	Image          Image
+	Init           *bool
 	Container      Container
 	IpcMode        string
+	Logging        ServiceLogging
 	MemLimit       int64
 	MemSwapLimit   int64
+	MemReservation int64
 	Networks       []ServiceNetwork
 	NetworkMode    string
 	OomKillDisable bool
+	PidsLimit      int64
 	Ports          []ServicePort
 	Privileged     bool
+	Profiles       []string
+	PullPolicy     string
 	Sysctls        map[string]string
 	Restart        string
-	Tty            bool
-	Volumes        []ServiceVolume
-	WorkingDir     string
+	Secrets        []ServiceFileReference
+	ShmSize        int64
+	StdinOpen      bool
+	StopSignal     string
+	// Time to wait for the container to stop before killing it. The default
+	// of the docker daemon applies when it is nil
+	StopGracePeriod *time.Duration
+	Tmpfs           []string
+	Tty             bool
+	Ulimits         []ServiceUlimit
+	Volumes         []ServiceVolume
+	WorkingDir      string
 }
 
 type ServiceBuild struct {
+	// Either a local directory or a git repository such as
+	// https://github.com/owner/repo.git#ref:subdir
 	Context    string
 	Dockerfile string
 	Args       map[string]*string
+	Target     string
+	Labels     Labels
+	CacheFrom  []string
+	ShmSize    int64
+	Network    string
+	ExtraHosts []string
+	// Commit a git context is checked out at instead of its ref, set by the
+	// supervisor
+	Revision string
+}
+
+type ServiceDependency struct {
+	Name      string
+	Condition string
+}
+
+type ServiceUlimit struct {
+	Name string
+	Soft int64
+	Hard int64
+}
+
+type ServiceDeviceRequest struct {
+	Driver       string
+	Count        int
+	DeviceIDs    []string
+	Capabilities []string
+	Options      map[string]string
 }
 
 type ServiceNetwork struct {
@@ -54,6 +114,16 @@ type ServiceVolume struct {
 	Source      string
 	Destination string
 	Option      string
+	ReadOnly    bool
+	Propagation string
+	NoCopy      bool
+	TmpfsSize   int64
+	TmpfsMode   uint32
+}
+
+type ServiceLogging struct {
+	Driver  string
+	Options map[string]string
 }
 
 type ServicePort struct {
@@ -64,8 +134,23 @@ type ServicePort struct {
 }
 
 const (
-	VolumeTypeBind  = "bind"
-	VolumeTypeMount = "mount"
+	VolumeTypeBind   = "bind"
+	VolumeTypeMount  = "mount"
+	VolumeTypeVolume = "volume"
+	VolumeTypeTmpfs  = "tmpfs"
+)
+
+const (
+	ConditionServiceStarted               = "service_started"
+	ConditionServiceHealthy               = "service_healthy"
+	ConditionServiceCompletedSuccessfully = "service_completed_successfully"
+)
+
+const (
+	PullPolicyAlways  = "always"
+	PullPolicyMissing = "missing"
+	PullPolicyNever   = "never"
+	PullPolicyBuild   = "build"
 )
 
 const (
@@ -75,9 +160,8 @@ const (
 	RestartUnlessStopped = "unless-stopped"
 )
 
-func GetBuildConfig(rawBuildConfig map[string]interface{}) ServiceBuild {
-	return ServiceBuild{
-		Context:    rawBuildConfig["context"].(string),
-		Dockerfile: rawBuildConfig["dockerfile"].(string),
-	}
+// HasBuild returns whether the image of the service is built from source
+// rather than pulled from a registry
+func (service Service) HasBuild() bool {
+	return service.BuildOpt.Context != ""
 }
@@ -3,5 +3,12 @@ package docker
 type Volumes []Volume
 
 type Volume struct {
-	Name string `json:"name"`
+	Name       string `json:"name"`
+	VolumeName string `json:"volume_name"`
+	Driver     string `json:"driver"`
+	DriverOpts map[string]string
+	Labels     Labels
+	// External volumes are managed outside of the project and are never
+	// created nor removed by the supervisor
+	External bool `json:"external"`
 }
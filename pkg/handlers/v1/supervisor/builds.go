@@ -0,0 +1,87 @@
+package supervisor
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Build struct {
+	ID         string `json:"id"`
+	Service    string `json:"service"`
+	Commit     string `json:"commit,omitempty"`
+	ImageID    string `json:"image_id,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+type BuildLogReader interface {
+	ListBuilds(ctx context.Context, service string) ([]Build, error)
+	GetBuild(ctx context.Context, id string) (Build, bool, error)
+	WriteBuildLog(ctx context.Context, id string, tail int, follow bool, w io.Writer) error
+}
+
+// MakeBuilds lists the builds, most recent first, optionally only those of
+// the service given by the service query parameter
+func MakeBuilds(parentCtx context.Context, reader BuildLogReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		builds, err := reader.ListBuilds(parentCtx, c.Query("service"))
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, builds)
+	}
+}
+
+// MakeBuildLog serves the log of a build. The tail query parameter limits the
+// output to the last lines, follow=true streams the log until the build
+// finishes and download=true serves it as an attachment
+func MakeBuildLog(parentCtx context.Context, reader BuildLogReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if _, found, err := reader.GetBuild(parentCtx, id); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		} else if !found {
+			c.JSON(404, gin.H{"error": "build not found"})
+			return
+		}
+
+		tail := 0
+		if value := c.Query("tail"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				c.JSON(400, gin.H{"error": "tail must be a non-negative number of lines"})
+				return
+			}
+			tail = parsed
+		}
+		follow := c.Query("follow") == "true"
+
+		if c.Query("download") == "true" {
+			c.Header("Content-Disposition", "attachment; filename="+id+".log")
+		}
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Status(200)
+		// Stops following the log once the client goes away
+		reader.WriteBuildLog(c.Request.Context(), id, tail, follow, flushWriter{c.Writer})
+	}
+}
+
+// flushWriter sends every write to the client right away so that the log of
+// a running build is streamed
+type flushWriter struct {
+	writer gin.ResponseWriter
+}
+
+func (w flushWriter) Write(content []byte) (int, error) {
+	written, err := w.writer.Write(content)
+	w.writer.Flush()
+	return written, err
+}
@@ -0,0 +1,31 @@
+package supervisor
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ProjectExporter interface {
+	ExportEnabled() bool
+	ExportProject(ctx context.Context) ([]byte, error)
+}
+
+// MakeProjectExport serves the deployed project as a compose file. The file
+// holds the resolved environment of every service, so it is only served when
+// the export is enabled
+func MakeProjectExport(parentCtx context.Context, exporter ProjectExporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !exporter.ExportEnabled() {
+			c.JSON(403, gin.H{"error": "project export is disabled"})
+			return
+		}
+		content, err := exporter.ExportProject(parentCtx)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=docker-compose.yml")
+		c.Data(200, "application/x-yaml", content)
+	}
+}
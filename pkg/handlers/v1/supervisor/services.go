@@ -0,0 +1,25 @@
+package supervisor
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ServiceState struct {
+	ServiceName   string `json:"service_name"`
+	ContainerName string `json:"container_name"`
+	ContainerID   string `json:"container_id"`
+	Status        string `json:"status"`
+	Health        string `json:"health"`
+}
+
+type ServicesStateReader interface {
+	ServicesState(ctx context.Context) []ServiceState
+}
+
+func MakeServicesState(parentCtx context.Context, reader ServicesStateReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(200, reader.ServicesState(parentCtx))
+	}
+}
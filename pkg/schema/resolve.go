@@ -0,0 +1,195 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Resolve interpolates the string values containing variables of a parsed
+// yaml document and gives them the type the schema expects. Values which are
+// valid strings are kept as strings, others are converted to the type of their
+// content, so that "${PRIVILEGED}" is decoded as a boolean where a boolean is
+// expected. Values that do not match the schema once interpolated are
+// reported, all problems at once
+func Resolve(file string, document *yaml.Node, schema *Schema, interpolate func(string) (string, error)) error {
+	if len(document.Content) == 0 {
+		return Errors{{File: file, Message: "file is empty"}}
+	}
+	resolver := resolver{
+		file:         file,
+		interpolate:  interpolate,
+		interpolated: map[*yaml.Node]bool{},
+	}
+	resolver.resolveNode(document.Content[0], schema, "")
+	if len(resolver.errs) > 0 {
+		return resolver.errs
+	}
+	return nil
+}
+
+type resolver struct {
+	file        string
+	interpolate func(string) (string, error)
+	// Nodes already interpolated, as anchored nodes are reached once for
+	// every alias
+	interpolated map[*yaml.Node]bool
+	errs         Errors
+}
+
+func (r *resolver) report(node *yaml.Node, path string, format string, args ...interface{}) {
+	r.errs = append(r.errs, Error{
+		File:    r.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *resolver) resolveNode(node *yaml.Node, schema *Schema, path string) {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	if schema == nil {
+		schema = Of(Any)
+	}
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		r.resolveScalar(node, schema, path)
+	case yaml.MappingNode:
+		schema = optionOfKind(schema, Mapping)
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			key := node.Content[idx].Value
+			valueNode := node.Content[idx+1]
+			keyPath := joinPath(path, key)
+			if key == "<<" {
+				// Merged mappings take the schema of the mapping they are
+				// merged into
+				r.resolveMerge(valueNode, schema, path)
+				continue
+			}
+			var field *Schema
+			if schema.Kind == Mapping {
+				if known, ok := schema.Fields[key]; ok {
+					field = known
+				} else if !(schema.AllowExtensions && strings.HasPrefix(key, "x-")) {
+					field = schema.Values
+				}
+			}
+			r.resolveNode(valueNode, field, keyPath)
+		}
+	case yaml.SequenceNode:
+		schema = optionOfKind(schema, Sequence)
+		var items *Schema
+		if schema.Kind == Sequence {
+			items = schema.Items
+		}
+		for idx, item := range node.Content {
+			r.resolveNode(item, items, fmt.Sprintf("%s[%d]", path, idx))
+		}
+	}
+}
+
+func (r *resolver) resolveMerge(node *yaml.Node, schema *Schema, path string) {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	if node.Kind == yaml.SequenceNode {
+		for _, item := range node.Content {
+			r.resolveNode(item, schema, path)
+		}
+		return
+	}
+	r.resolveNode(node, schema, path)
+}
+
+func (r *resolver) resolveScalar(node *yaml.Node, schema *Schema, path string) {
+	if !r.interpolated[node] {
+		if !isInterpolated(node) {
+			return
+		}
+		value, err := r.interpolate(node.Value)
+		if err != nil {
+			r.report(node, path, "%s", err)
+			return
+		}
+		node.Value = value
+		r.interpolated[node] = true
+	}
+
+	if acceptsTag(schema, node.Tag, node.Value) {
+		return
+	}
+	if acceptsTag(schema, "!!str", node.Value) {
+		node.Tag = "!!str"
+		return
+	}
+	if tag := contentTag(node.Value); acceptsTag(schema, tag, node.Value) {
+		node.Tag = tag
+		node.Style = 0
+		return
+	}
+	if len(schema.Enum) > 0 {
+		r.report(node, path, "expected one of %s, got %q once interpolated", strings.Join(schema.Enum, ", "), node.Value)
+		return
+	}
+	r.report(node, path, "expected %s, got %q once interpolated", describe(schema), node.Value)
+}
+
+// Alternative of a OneOf describing nodes of the given kind, or the schema
+// itself if it is not a OneOf
+func optionOfKind(schema *Schema, kind Kind) *Schema {
+	if schema.Kind != OneOf {
+		return schema
+	}
+	for _, option := range schema.Options {
+		if option := optionOfKind(option, kind); option.Kind == kind {
+			return option
+		}
+	}
+	return Of(Any)
+}
+
+// Whether a scalar with the given tag and value is valid against the schema
+func acceptsTag(schema *Schema, tag string, value string) bool {
+	switch schema.Kind {
+	case Any:
+		return true
+	case OneOf:
+		for _, option := range schema.Options {
+			if acceptsTag(option, tag, value) {
+				return true
+			}
+		}
+		return false
+	case Mapping, Sequence:
+		return false
+	}
+	if !matchesTag(tag, schema.Kind) {
+		return false
+	}
+	if len(schema.Enum) == 0 {
+		return true
+	}
+	for _, allowed := range schema.Enum {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag the value would have if it was written as a plain scalar
+func contentTag(value string) string {
+	document := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(value), &document); err != nil || len(document.Content) == 0 {
+		return "!!str"
+	}
+	if node := document.Content[0]; node.Kind == yaml.ScalarNode && node.Style == 0 {
+		return node.Tag
+	}
+	return "!!str"
+}
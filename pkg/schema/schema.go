@@ -0,0 +1,310 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Kind int
+
+const (
+	Any Kind = iota
+	String
+	Bool
+	Int
+	Number
+	Scalar
+	Null
+	Mapping
+	Sequence
+	OneOf
+)
+
+// Schema describes the expected structure of a yaml node
+type Schema struct {
+	Kind Kind
+	// Known keys of a mapping
+	Fields map[string]*Schema
+	// Keys that must be present in a mapping
+	Required []string
+	// Schema of the keys of a mapping that are not listed in Fields. Unknown
+	// keys are rejected when it is nil
+	Values *Schema
+	// Allow keys starting with x- in a mapping, as with compose extensions
+	AllowExtensions bool
+	// Schema of the items of a sequence
+	Items *Schema
+	// Alternatives of a OneOf
+	Options []*Schema
+	// Allowed values of a string
+	Enum []string
+}
+
+// Error reports a single problem found while validating a file
+type Error struct {
+	File    string
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e Error) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", location, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, e.Path, e.Message)
+}
+
+// Errors reports every problem found in a file
+type Errors []Error
+
+func (e Errors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+func Of(kind Kind) *Schema {
+	return &Schema{Kind: kind}
+}
+
+func ListOf(items *Schema) *Schema {
+	return &Schema{Kind: Sequence, Items: items}
+}
+
+func MapOf(values *Schema) *Schema {
+	return &Schema{Kind: Mapping, Values: values}
+}
+
+func Either(options ...*Schema) *Schema {
+	return &Schema{Kind: OneOf, Options: options}
+}
+
+func Enum(values ...string) *Schema {
+	return &Schema{Kind: String, Enum: values}
+}
+
+// Validate parses the content of a yaml file and checks it against the schema.
+// All problems are reported at once
+func Validate(file string, content []byte, schema *Schema) error {
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return Errors{{File: file, Message: err.Error()}}
+	}
+	if len(document.Content) == 0 {
+		return Errors{{File: file, Message: "file is empty"}}
+	}
+
+	errs := Errors{}
+	validateNode(file, document.Content[0], schema, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateNode(file string, node *yaml.Node, schema *Schema, path string, errs *Errors) {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	report := func(node *yaml.Node, path string, format string, args ...interface{}) {
+		*errs = append(*errs, Error{
+			File:    file,
+			Line:    node.Line,
+			Column:  node.Column,
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	switch schema.Kind {
+	case Any:
+		return
+	case OneOf:
+		for _, option := range schema.Options {
+			optionErrs := Errors{}
+			validateNode(file, node, option, path, &optionErrs)
+			if len(optionErrs) == 0 {
+				return
+			}
+		}
+		// Report the errors of the alternative matching the kind of the node
+		// as it is most likely the intended one
+		for _, option := range schema.Options {
+			if matchesKind(node, option.Kind) && option.Kind != Scalar && option.Kind != Any {
+				validateNode(file, node, option, path, errs)
+				return
+			}
+		}
+		report(node, path, "expected %s, got %s", describe(schema), describeNode(node))
+	case Mapping:
+		if node.Kind != yaml.MappingNode {
+			report(node, path, "expected %s, got %s", describe(schema), describeNode(node))
+			return
+		}
+		present := map[string]bool{}
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			keyNode := node.Content[idx]
+			valueNode := node.Content[idx+1]
+			key := keyNode.Value
+			present[key] = true
+			keyPath := joinPath(path, key)
+			if key == "<<" {
+				continue
+			}
+			if field, ok := schema.Fields[key]; ok {
+				validateNode(file, valueNode, field, keyPath, errs)
+			} else if schema.AllowExtensions && strings.HasPrefix(key, "x-") {
+				continue
+			} else if schema.Values != nil {
+				validateNode(file, valueNode, schema.Values, keyPath, errs)
+			} else {
+				report(keyNode, keyPath, "unknown key")
+			}
+		}
+		for _, required := range schema.Required {
+			if !present[required] {
+				report(node, joinPath(path, required), "missing required key")
+			}
+		}
+	case Sequence:
+		if node.Kind != yaml.SequenceNode {
+			report(node, path, "expected %s, got %s", describe(schema), describeNode(node))
+			return
+		}
+		if schema.Items == nil {
+			return
+		}
+		for idx, item := range node.Content {
+			validateNode(file, item, schema.Items, fmt.Sprintf("%s[%d]", path, idx), errs)
+		}
+	default:
+		if !matchesKind(node, schema.Kind) {
+			report(node, path, "expected %s, got %s", describe(schema), describeNode(node))
+			return
+		}
+		if len(schema.Enum) > 0 && !isInterpolated(node) {
+			for _, value := range schema.Enum {
+				if node.Value == value {
+					return
+				}
+			}
+			report(node, path, "expected one of %s, got %q", strings.Join(schema.Enum, ", "), node.Value)
+		}
+	}
+}
+
+// Values containing variables are only known after interpolation, so they
+// are accepted wherever a scalar is expected. Their type is checked once they
+// are interpolated, see Resolve
+func isInterpolated(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!str" && strings.Contains(node.Value, "$")
+}
+
+func matchesKind(node *yaml.Node, kind Kind) bool {
+	switch kind {
+	case Any:
+		return true
+	case Mapping:
+		return node.Kind == yaml.MappingNode
+	case Sequence:
+		return node.Kind == yaml.SequenceNode
+	}
+	if node.Kind != yaml.ScalarNode {
+		return false
+	}
+	switch kind {
+	case Bool, Int, Number:
+		return matchesTag(node.Tag, kind) || isInterpolated(node)
+	}
+	return matchesTag(node.Tag, kind)
+}
+
+// Whether a scalar with the given tag is of the given kind
+func matchesTag(tag string, kind Kind) bool {
+	switch kind {
+	case Any:
+		return true
+	case String:
+		return tag == "!!str"
+	case Bool:
+		return tag == "!!bool"
+	case Int:
+		return tag == "!!int"
+	case Number:
+		return tag == "!!int" || tag == "!!float"
+	case Null:
+		return tag == "!!null"
+	case Scalar:
+		return tag != "!!null"
+	}
+	return false
+}
+
+func describe(schema *Schema) string {
+	switch schema.Kind {
+	case String:
+		return "a string"
+	case Bool:
+		return "a boolean"
+	case Int:
+		return "an integer"
+	case Number:
+		return "a number"
+	case Scalar:
+		return "a scalar"
+	case Null:
+		return "nothing"
+	case Mapping:
+		return "a mapping"
+	case Sequence:
+		return "a list"
+	case OneOf:
+		options := []string{}
+		for _, option := range schema.Options {
+			options = append(options, describe(option))
+		}
+		sort.Strings(options)
+		return strings.Join(options, " or ")
+	}
+	return "anything"
+}
+
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch node.Tag {
+	case "!!str":
+		return fmt.Sprintf("string %q", node.Value)
+	case "!!bool":
+		return fmt.Sprintf("boolean %s", node.Value)
+	case "!!int":
+		return fmt.Sprintf("integer %s", node.Value)
+	case "!!float":
+		return fmt.Sprintf("number %s", node.Value)
+	case "!!null":
+		return "nothing"
+	}
+	return node.Value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
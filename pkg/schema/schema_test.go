@@ -0,0 +1,180 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+var testSchema = &Schema{
+	Kind:            Mapping,
+	AllowExtensions: true,
+	Fields: map[string]*Schema{
+		"name":       Of(String),
+		"privileged": Of(Bool),
+		"retries":    Of(Int),
+		"cpus":       Either(Of(Number), Of(String)),
+		"mode":       Enum("host", "ingress"),
+		"labels":     Either(MapOf(Either(Of(String), Of(Number), Of(Bool))), ListOf(Of(String))),
+		"command":    Either(Of(String), ListOf(Of(String))),
+		"options":    {Kind: Mapping, Fields: map[string]*Schema{"init": Of(Bool)}, Required: []string{"init"}},
+	},
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errors  []string
+	}{
+		{
+			name:    "valid document",
+			content: "name: app\nprivileged: true\nretries: 3\ncpus: 0.5\nmode: host\nlabels: [a=b]\noptions: {init: false}\n",
+		},
+		{
+			name:    "unknown key",
+			content: "name: app\nunknown: 1\n",
+			errors:  []string{"unknown: unknown key"},
+		},
+		{
+			name:    "extensions are allowed",
+			content: "x-common: {anything: [1]}\n",
+		},
+		{
+			name:    "wrong scalar type",
+			content: "privileged: yes\nretries: three\n",
+			errors:  []string{`privileged: expected a boolean, got string "yes"`, `retries: expected an integer, got string "three"`},
+		},
+		{
+			name:    "value outside of enum",
+			content: "mode: bridge\n",
+			errors:  []string{`mode: expected one of host, ingress, got "bridge"`},
+		},
+		{
+			name:    "missing required key",
+			content: "options: {}\n",
+			errors:  []string{"options.init: missing required key"},
+		},
+		{
+			name:    "interpolated values are accepted before interpolation",
+			content: "privileged: ${PRIVILEGED}\nretries: $RETRIES\nmode: ${MODE}\n",
+		},
+		{
+			name:    "errors of the matching alternative are reported",
+			content: "labels: {a: [b]}\n",
+			errors:  []string{"labels.a: expected a boolean or a number or a string, got a list"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate("test.yml", []byte(test.content), testSchema)
+			if len(test.errors) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %v", test.errors)
+			}
+			for _, expected := range test.errors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected %q in %q", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	environment := map[string]string{
+		"TRUE":    "true",
+		"THREE":   "3",
+		"HALF":    "0.5",
+		"WORD":    "word",
+		"HOST":    "host",
+		"NUMERIC": "42",
+	}
+	interpolate := func(value string) (string, error) {
+		return strings.NewReplacer(
+			"${TRUE}", environment["TRUE"],
+			"${THREE}", environment["THREE"],
+			"${HALF}", environment["HALF"],
+			"${WORD}", environment["WORD"],
+			"${HOST}", environment["HOST"],
+			"${NUMERIC}", environment["NUMERIC"],
+		).Replace(value), nil
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string]interface{}
+		errors   []string
+	}{
+		{
+			name:     "scalars take the type of the schema",
+			content:  "privileged: ${TRUE}\nretries: \"${THREE}\"\n",
+			expected: map[string]interface{}{"privileged": true, "retries": 3},
+		},
+		{
+			name:     "valid strings are kept as strings",
+			content:  "name: ${NUMERIC}\ncpus: ${HALF}\ncommand: [run, \"${THREE}\"]\nlabels:\n  a: ${THREE}\n",
+			expected: map[string]interface{}{"name": "42", "cpus": "0.5", "command": []interface{}{"run", "3"}, "labels": map[string]interface{}{"a": "3"}},
+		},
+		{
+			name:     "enums are checked once interpolated",
+			content:  "mode: ${HOST}\n",
+			expected: map[string]interface{}{"mode": "host"},
+		},
+		{
+			name:    "invalid values are reported once interpolated",
+			content: "privileged: ${WORD}\nretries: ${HALF}\nmode: ${WORD}\n",
+			errors: []string{
+				`privileged: expected a boolean, got "word" once interpolated`,
+				`retries: expected an integer, got "0.5" once interpolated`,
+				`mode: expected one of host, ingress, got "word" once interpolated`,
+			},
+		},
+		{
+			name:    "merged anchors take the schema of the mapping they are merged into",
+			content: "x-common: &common\n  init: ${TRUE}\noptions:\n  <<: *common\n",
+			// yaml.v3 decodes mappings with merge keys with interface keys
+			expected: map[string]interface{}{"x-common": map[string]interface{}{"init": true}, "options": map[interface{}]interface{}{"init": true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document := yaml.Node{}
+			if err := yaml.Unmarshal([]byte(test.content), &document); err != nil {
+				t.Fatal(err)
+			}
+			err := Resolve("test.yml", &document, testSchema, interpolate)
+			if len(test.errors) > 0 {
+				if err == nil {
+					t.Fatalf("expected errors %v", test.errors)
+				}
+				for _, expected := range test.errors {
+					if !strings.Contains(err.Error(), expected) {
+						t.Errorf("expected %q in %q", expected, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			decoded := map[string]interface{}{}
+			if err := document.Decode(&decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, decoded)
+			}
+		})
+	}
+}
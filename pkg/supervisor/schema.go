@@ -0,0 +1,37 @@
+package supervisor
+
+import (
+	"github.com/dkhoanguyen/ros-supervisor/pkg/schema"
+)
+
+var repoSchema = &schema.Schema{
+	Kind:     schema.Mapping,
+	Required: []string{"url", "branch"},
+	Fields: map[string]*schema.Schema{
+		"url":            schema.Of(schema.String),
+		"branch":         schema.Of(schema.String),
+		"current_commit": schema.Either(schema.Of(schema.String), schema.Of(schema.Null)),
+	},
+}
+
+// ConfigSchema describes the supervisor configuration file
+var ConfigSchema = &schema.Schema{
+	Kind:            schema.Mapping,
+	AllowExtensions: true,
+	Required:        []string{"context", "services"},
+	Fields: map[string]*schema.Schema{
+		"info": schema.Of(schema.Any),
+		"context": &schema.Schema{
+			Kind:     schema.Mapping,
+			Required: []string{"use_git_context", "url", "branch"},
+			Fields: map[string]*schema.Schema{
+				"use_git_context": schema.Of(schema.Bool),
+				"url":             schema.Of(schema.String),
+				"branch":          schema.Of(schema.String),
+			},
+		},
+		"profiles": schema.ListOf(schema.Of(schema.String)),
+		"core":     schema.Of(schema.Any),
+		"services": schema.MapOf(schema.ListOf(repoSchema)),
+	},
+}
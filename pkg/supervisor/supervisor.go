@@ -3,22 +3,27 @@ package supervisor
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dkhoanguyen/ros-supervisor/internal/env"
 	"github.com/dkhoanguyen/ros-supervisor/internal/logging"
 	"github.com/dkhoanguyen/ros-supervisor/internal/utils"
 	"github.com/dkhoanguyen/ros-supervisor/pkg/compose"
+	"github.com/dkhoanguyen/ros-supervisor/pkg/docker"
 	"github.com/dkhoanguyen/ros-supervisor/pkg/github"
 	"github.com/dkhoanguyen/ros-supervisor/pkg/handlers/health"
 	"github.com/dkhoanguyen/ros-supervisor/pkg/handlers/v1/supervisor"
+	"github.com/dkhoanguyen/ros-supervisor/pkg/schema"
 	"github.com/docker/docker/client"
 	"github.com/gin-gonic/gin"
 	gh "github.com/google/go-github/github"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v3"
@@ -36,6 +41,9 @@ type SupervisorService struct {
 	ContainerID   string
 	Repos         []github.Repo
 	UpdateReady   bool
+	// Upstream commits whose update failed and was rolled back. They are not
+	// retried until a new commit is pushed
+	FailedCommits []string
 }
 
 type RosSupervisor struct {
@@ -47,29 +55,41 @@ type RosSupervisor struct {
 	ProjectDir         string
 	MonitorTimeout     time.Duration
 	ConfigFile         []byte
+	Profiles           []string
+	Logger             *zap.Logger
+	// Whether the deployed project, environment included, can be exported
+	// through the API
+	AllowExport bool
+	// Guards the project and the services, which are replaced and updated by
+	// the supervisor loop while the handlers read them
+	mutex *sync.RWMutex
 }
 
 type SupervisorCommand struct {
 	Update bool `json:"update"`
 }
 
-func CreateRosSupervisor(ctx context.Context, githubClient *gh.Client, configPath string, projectDir string, logger *zap.Logger) (RosSupervisor, string) {
+func CreateRosSupervisor(ctx context.Context, githubClient *gh.Client, configPath string, projectDir string, logger *zap.Logger) (RosSupervisor, string, error) {
 	supProject := RosSupervisor{}
 	configFile, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		panic(err)
+		return supProject, "", errors.Wrapf(err, "unable to read supervisor config %s", configPath)
+	}
+	if err := schema.Validate(configPath, configFile, ConfigSchema); err != nil {
+		return supProject, "", err
 	}
 	rawData := make(map[interface{}]interface{})
-	err2 := yaml.Unmarshal(configFile, &rawData)
-	if err2 != nil {
-		log.Fatal(err2)
+	if err := yaml.Unmarshal(configFile, &rawData); err != nil {
+		return supProject, "", errors.Wrapf(err, "unable to extract supervisor config %s", configPath)
 	}
+	supProject.ConfigFile = configFile
 	supProject.ProjectCtx = extractProjectContext(rawData, logger)
 	supProject.SupervisorServices = extractServices(rawData, ctx, githubClient, logger)
+	supProject.Profiles = extractProfiles(rawData)
 
 	// If use_git_context then get the latest commit and use it as the build context
 	projectPath := prepareProjectDirFromGit(supProject.ProjectCtx, projectDir, logger)
-	return supProject, projectPath
+	return supProject, projectPath, nil
 }
 
 func extractProjectContext(rawData map[interface{}]interface{}, logger *zap.Logger) ProjectContext {
@@ -81,6 +101,18 @@ func extractProjectContext(rawData map[interface{}]interface{}, logger *zap.Logg
 	return ctx
 }
 
+func extractProfiles(rawData map[interface{}]interface{}) []string {
+	profiles := []string{}
+	if rawProfiles, ok := rawData["profiles"].([]interface{}); ok {
+		for _, profile := range rawProfiles {
+			if name, ok := profile.(string); ok {
+				profiles = append(profiles, name)
+			}
+		}
+	}
+	return profiles
+}
+
 func extractServices(rawData map[interface{}]interface{}, ctx context.Context, githubClient *gh.Client, logger *zap.Logger) SupervisorServices {
 	supServices := SupervisorServices{}
 	services := rawData["services"].(map[string]interface{})
@@ -153,10 +185,25 @@ func Execute() {
 		logger.Fatal(fmt.Sprintf("%s", err))
 	}
 
+	compose.ImageHistoryLimit = envConfig.SupervisorImageHistory
+	compose.BuildWorkers = envConfig.SupervisorBuildWorkers
+	compose.BuildLogDir = envConfig.SupervisorBuildLogDir
+	compose.BuildContextSizeLimit = envConfig.SupervisorBuildContextLimit * 1024 * 1024
+	compose.SecretsDir = envConfig.SupervisorSecretsDir
+	compose.SecretsHostDir = envConfig.SupervisorSecretsHostDir
+	compose.DependencyWaitTimeout = time.Duration(envConfig.SupervisorDependencyTimeout) * time.Second
+	compose.UpdateReadyTimeout = time.Duration(envConfig.SupervisorUpdateTimeout) * time.Second
+	if err := compose.FailStaleBuilds(); err != nil {
+		logger.Error(fmt.Sprintf("Unable to fail stale builds with error: %s", err))
+	}
+
 	rs := RosSupervisor{
-		GitCli:     gitClient,
-		DockerCli:  dockerCli,
-		ProjectDir: envConfig.SupervisorProjectPath,
+		GitCli:      gitClient,
+		DockerCli:   dockerCli,
+		ProjectDir:  envConfig.SupervisorProjectPath,
+		Logger:      logger,
+		AllowExport: envConfig.SupervisorExportProject,
+		mutex:       &sync.RWMutex{},
 	}
 
 	// Router and handlers
@@ -168,6 +215,10 @@ func Execute() {
 
 	router.GET("/health/liveness", health.LivenessGet)
 	router.POST("/cmd", supervisor.MakeCommand(ctx, &cmd))
+	router.GET("/services/state", supervisor.MakeServicesState(ctx, &rs))
+	router.GET("/project/compose", supervisor.MakeProjectExport(ctx, &rs))
+	router.GET("/builds", supervisor.MakeBuilds(ctx, &rs))
+	router.GET("/builds/:id/log", supervisor.MakeBuildLog(ctx, &rs))
 	go router.Run("172.21.0.2:8080")
 
 	for {
@@ -186,7 +237,28 @@ func Execute() {
 				logger.Fatal(fmt.Sprintf("%s", err))
 			}
 
-			PrepareSupervisor(ctx, &rs, &cmd)
+			prepared, err := PrepareSupervisor(ctx, &rs, &cmd)
+			if err != nil {
+				logInvalidFiles(err, logger)
+				// Drop the update request so that the broken files are not
+				// reloaded until a new one is received
+				cmd.UpdateCore = false
+				cmd.UpdateServices = false
+				if rs.DockerProject == nil {
+					time.Sleep(2 * time.Second)
+					continue
+				}
+				logger.Warn("Keeping the last valid project running")
+				StartSupervisor(ctx, &rs, dockerCli, gitClient, &cmd, logger)
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			rs.update(func() {
+				rs.ProjectCtx = prepared.ProjectCtx
+				rs.Profiles = prepared.Profiles
+				rs.DockerProject = prepared.DockerProject
+				rs.SupervisorServices = prepared.SupervisorServices
+			})
 			StartSupervisor(ctx, &rs, dockerCli, gitClient, &cmd, logger)
 			time.Sleep(2 * time.Second)
 
@@ -196,7 +268,18 @@ func Execute() {
 	}
 }
 
-func PrepareSupervisor(ctx context.Context, supervisor *RosSupervisor, cmd *supervisor.SupervisorCommand) RosSupervisor {
+// Log every problem found in the compose files or the supervisor config
+func logInvalidFiles(err error, logger *zap.Logger) {
+	if validationErrs, ok := errors.Cause(err).(schema.Errors); ok {
+		for _, validationErr := range validationErrs {
+			logger.Error(fmt.Sprintf("Invalid file: %s", validationErr))
+		}
+		return
+	}
+	logger.Error(fmt.Sprintf("Unable to load project with error: %s", err))
+}
+
+func PrepareSupervisor(ctx context.Context, supervisor *RosSupervisor, cmd *supervisor.SupervisorCommand) (RosSupervisor, error) {
 
 	localCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -208,69 +291,67 @@ func PrepareSupervisor(ctx context.Context, supervisor *RosSupervisor, cmd *supe
 
 	logger := logging.Make(envConfig)
 	projectDir := envConfig.SupervisorProjectPath
-	composeFile := envConfig.SupervisorComposeFile
+	composeFiles := envConfig.SupervisorComposeFiles
 	configFile := envConfig.SupervisorConfigFile
 
 	dockerCli := supervisor.DockerCli
 	gitClient := supervisor.GitCli
 
-	rs, projectPath := CreateRosSupervisor(localCtx, gitClient, configFile, projectDir, logger)
-
-	composeProject := compose.CreateProject(composeFile, projectPath, logger)
-	_, err = os.Stat("/supervisor/supervisor_services.yml")
-
-	if err != nil || cmd.UpdateServices || cmd.UpdateCore {
-		// File does not exist
-		// Check to see if there is any container with the given name is running
-		// If yes then stop and remove all of them to rebuild the project
-		// In the future, for ROS integration we should keep core running, as it is
-		// rarely changed
-		allRunningContainers, err := compose.ListAllContainers(localCtx, dockerCli, logger)
-		if err != nil {
+	rs, projectPath, err := CreateRosSupervisor(localCtx, gitClient, configFile, projectDir, logger)
+	if err != nil {
+		return rs, err
+	}
 
+	activeProfiles := append(envConfig.SupervisorProfiles, rs.Profiles...)
+	composeProject, err := compose.CreateProject(composeFiles, projectPath, activeProfiles, logger)
+	if err != nil {
+		if rs.ProjectCtx.UseGitContext {
+			os.RemoveAll(projectPath)
 		}
-		for _, cnt := range allRunningContainers {
-			// If service only then stop them
-			if strings.Contains(cnt.Names[0], composeProject.Name) && !strings.Contains(cnt.Names[0], "core") {
-				logger.Info(fmt.Sprintf("Stopping service %s", cnt.Names[0]))
-				ID := cnt.ID
-				compose.StopServiceByID(ctx, dockerCli, ID, logger)
-				compose.RemoveServiceByID(ctx, dockerCli, ID, logger)
-			} else {
-				// Only stop core if the request flag is true
-				if strings.Contains(cnt.Names[0], "core") && cmd.UpdateCore {
-					logger.Info(fmt.Sprintf("Stopping service %s", cnt.Names[0]))
-					ID := cnt.ID
-					compose.StopServiceByID(ctx, dockerCli, ID, logger)
-					compose.RemoveServiceByID(ctx, dockerCli, ID, logger)
-				}
-			}
+		return rs, err
+	}
+	for idx := range rs.SupervisorServices {
+		if targetService := findService(&composeProject, rs.SupervisorServices[idx].ServiceName); targetService != nil {
+			targetService.Commit = rs.SupervisorServices[idx].Commits(false)
+			targetService.BuildOpt.Revision = rs.SupervisorServices[idx].BuildRevision(targetService, false)
 		}
-
-		if _, err = os.Stat("/supervisor/supervisor_services.yml"); err != nil {
-			// If this is the first run - build all services including core
-			logger.Info("Building core and services")
-			compose.BuildAll(localCtx, dockerCli, &composeProject, logger)
-			compose.CreateContainers(localCtx, dockerCli, &composeProject, logger)
-			compose.StartAll(localCtx, dockerCli, &composeProject, logger)
-		} else {
-			// If we receive update request from user, build and update services based on the received request
-			// Note only build if valid cmd is received
-			if cmd.UpdateCore {
-				logger.Info("Building core and services")
-				compose.BuildAll(localCtx, dockerCli, &composeProject, logger)
-				compose.CreateContainers(localCtx, dockerCli, &composeProject, logger)
-				compose.StartAll(localCtx, dockerCli, &composeProject, logger)
-			} else if cmd.UpdateServices {
-				logger.Info("Building services")
-				compose.BuildServices(localCtx, dockerCli, &composeProject, logger)
-				compose.CreateServiceContainers(localCtx, dockerCli, &composeProject, logger)
-				compose.StartServices(localCtx, dockerCli, &composeProject, logger)
-			}
+	}
+	_, err = os.Stat("/supervisor/supervisor_services.yml")
+	firstRun := err != nil
+
+	// Rebuild the images of the requested update. Containers are then only
+	// recreated when their configuration or image changed, so core keeps
+	// running unless it is affected
+	var buildResults compose.BuildResults
+	var buildErr error
+	if cmd.UpdateCore {
+		buildResults, buildErr = compose.BuildAll(localCtx, dockerCli, &composeProject, logger)
+	} else if cmd.UpdateServices {
+		buildResults, buildErr = compose.BuildServices(localCtx, dockerCli, &composeProject, logger)
+	}
+	if buildErr != nil {
+		logger.Error(fmt.Sprintf("Unable to build the project with error: %s", buildErr))
+	}
+	for _, result := range buildResults {
+		if result.Err == nil {
+			logger.Info(fmt.Sprintf("Service %s: image %s prepared in %s", result.Service, result.ImageID, result.Duration))
+		}
+	}
+	// Containers may already have been replaced, so the project is adopted
+	// even if some services could not be reconciled
+	reconcileResults, reconcileErr := compose.Reconcile(localCtx, dockerCli, &composeProject, logger)
+	if reconcileErr != nil {
+		logger.Error(fmt.Sprintf("Unable to reconcile the project with error: %s", reconcileErr))
+	}
+	for _, result := range reconcileResults {
+		if result.Err == nil {
+			logger.Info(fmt.Sprintf("Service %s: %s done", result.Service, result.Action))
 		}
+	}
+	rs.DockerProject = &composeProject
 
+	if firstRun || cmd.UpdateServices || cmd.UpdateCore {
 		// Update supervisor
-		rs.DockerProject = &composeProject
 		rs.AttachContainers()
 		data, _ := yaml.Marshal(&rs.SupervisorServices)
 		ioutil.WriteFile("/supervisor/supervisor_services.yml", data, 0777)
@@ -278,40 +359,7 @@ func PrepareSupervisor(ctx context.Context, supervisor *RosSupervisor, cmd *supe
 		// Reset update flag
 		cmd.UpdateCore = false
 		cmd.UpdateServices = false
-
 	} else {
-		// File exist or no update request receives -> Start the process normally
-		// Extract existing info
-		logger.Info("Extracting running services")
-		allContainers, err := compose.ListAllContainers(localCtx, dockerCli, logger)
-		if err != nil {
-
-		}
-
-		for _, cnt := range allContainers {
-			for idx, service := range composeProject.Services {
-				if composeProject.Name+"_"+service.Name == cnt.Names[0][1:] {
-					composeProject.Services[idx].Container.ID = cnt.ID
-				}
-			}
-		}
-		allImages, err := compose.ListAllImages(localCtx, dockerCli, logger)
-		if err != nil {
-
-		}
-
-		for _, img := range allImages {
-			splitString := strings.Split(img.RepoTags[0], ":")
-			imageName := splitString[0]
-
-			for idx, service := range composeProject.Services {
-				name := composeProject.Name + "_" + service.Name
-				if imageName == name {
-					composeProject.Services[idx].Image.ID = img.ID
-				}
-			}
-		}
-
 		serviceData := make([]SupervisorService, len(rs.SupervisorServices))
 		yfile, _ := ioutil.ReadFile("/supervisor/supervisor_services.yml")
 		yaml.Unmarshal(yfile, &serviceData)
@@ -323,7 +371,7 @@ func PrepareSupervisor(ctx context.Context, supervisor *RosSupervisor, cmd *supe
 	if err != nil {
 		logger.Error(fmt.Sprintf("Cannot remove project directory with error %v", err))
 	}
-	return rs
+	return rs, nil
 }
 
 func StartSupervisor(ctx context.Context, supervisor *RosSupervisor, dockeClient *client.Client, gitClient *gh.Client, cmd *supervisor.SupervisorCommand, logger *zap.Logger) {
@@ -333,15 +381,24 @@ func StartSupervisor(ctx context.Context, supervisor *RosSupervisor, dockeClient
 	for {
 		triggerUpdate := false
 		for idx := range supervisor.SupervisorServices {
-			for _, repo := range supervisor.SupervisorServices[idx].Repos {
+			for repoIdx := range supervisor.SupervisorServices[idx].Repos {
+				repo := supervisor.SupervisorServices[idx].Repos[repoIdx]
 				upStreamCommit, err := repo.UpdateUpStreamCommit(localCtx, gitClient, logger)
 				if err != nil {
 
 				}
+				supervisor.update(func() {
+					supervisor.SupervisorServices[idx].Repos[repoIdx] = repo
+				})
 				if repo.IsUpdateReady() {
-					supervisor.SupervisorServices[idx].UpdateReady = true
+					if supervisor.SupervisorServices[idx].HasFailed(supervisor.SupervisorServices[idx].Commits(true)) {
+						continue
+					}
+					supervisor.update(func() {
+						supervisor.SupervisorServices[idx].UpdateReady = true
+					})
 					triggerUpdate = true
-					fmt.Printf("Update for service %s is ready. Upstream commit: %s\n", supervisor.SupervisorServices[idx].ContainerName, upStreamCommit)
+					logger.Info(fmt.Sprintf("Update for service %s is ready. Upstream commit: %s", supervisor.SupervisorServices[idx].ContainerName, upStreamCommit))
 				}
 			}
 		}
@@ -349,31 +406,54 @@ func StartSupervisor(ctx context.Context, supervisor *RosSupervisor, dockeClient
 		if triggerUpdate {
 			logger.Info("Update is ready. Performing updates")
 			for idx := range supervisor.SupervisorServices {
-				if supervisor.SupervisorServices[idx].UpdateReady {
-					for srvIdx := range supervisor.DockerProject.Services {
-						if supervisor.DockerProject.Services[srvIdx].Name == supervisor.SupervisorServices[idx].ServiceName {
-							compose.StopService(localCtx, dockeClient, &supervisor.DockerProject.Services[srvIdx])
-							compose.RemoveService(localCtx, dockeClient, &supervisor.DockerProject.Services[srvIdx], logger)
-
-							compose.BuildSingle(localCtx, dockeClient, supervisor.DockerProject.Name, &supervisor.DockerProject.Services[srvIdx], logger)
-							compose.CreateNetwork(localCtx, supervisor.DockerProject, dockeClient, false, logger)
-							compose.CreateSingleContainer(localCtx, supervisor.DockerProject.Name, &supervisor.DockerProject.Services[srvIdx], &supervisor.DockerProject.Networks[0], dockeClient, logger)
-							compose.StartSingleServiceContainer(localCtx, dockeClient, &supervisor.DockerProject.Services[srvIdx], logger)
-							supervisor.SupervisorServices[idx].UpdateReady = false
-						}
-					}
-
-					for repoIdx := range supervisor.SupervisorServices[idx].Repos {
-						_, err := supervisor.SupervisorServices[idx].Repos[repoIdx].GetCurrentLocalCommit(localCtx, gitClient, "", logger)
-						if err != nil {
+				if !supervisor.SupervisorServices[idx].UpdateReady {
+					continue
+				}
+				supervisorService := &supervisor.SupervisorServices[idx]
+				supervisor.update(func() {
+					supervisorService.UpdateReady = false
+				})
+				targetService := findService(supervisor.DockerProject, supervisorService.ServiceName)
+				if targetService == nil || !supervisor.DockerProject.IsServiceEnabled(targetService) {
+					continue
+				}
 
+				// The service is updated on a copy so that the handlers are not
+				// blocked during the build
+				upstreamCommits := supervisorService.Commits(true)
+				updated := *targetService
+				updated.Commit = upstreamCommits
+				updated.BuildOpt.Revision = supervisorService.BuildRevision(&updated, true)
+				// Networks are created on a copy of the project so that the
+				// handlers are not blocked by the docker calls
+				networkProject := *supervisor.DockerProject
+				networkProject.Networks = append(docker.Networks{}, supervisor.DockerProject.Networks...)
+				if err := compose.CreateNetwork(localCtx, &networkProject, dockeClient, logger); err != nil {
+					logger.Error(fmt.Sprintf("Unable to create networks for service %s with error: %s. Skipping update", supervisorService.ServiceName, err))
+					continue
+				}
+				supervisor.update(func() {
+					supervisor.DockerProject.Networks = networkProject.Networks
+				})
+				// The service is restored to its current configuration, commits
+				// included, if the update fails
+				err := compose.UpdateService(localCtx, dockeClient, supervisor.DockerProject, *targetService, &updated, logger)
+				supervisor.update(func() {
+					if err != nil {
+						logger.Error(fmt.Sprintf("Unable to update service %s to commits %s with error: %s", supervisorService.ServiceName, upstreamCommits, err))
+						supervisorService.FailedCommits = append(supervisorService.FailedCommits, upstreamCommits)
+					} else {
+						for repoIdx := range supervisorService.Repos {
+							repo := &supervisorService.Repos[repoIdx]
+							repo.GetCurrentLocalCommit(localCtx, gitClient, repo.UpstreamCommit, logger)
 						}
 					}
-				}
+					*targetService = updated
+				})
 			}
 
 			data, _ := yaml.Marshal(&supervisor.SupervisorServices)
-			ioutil.WriteFile("supervisor_services.yml", data, 0777)
+			ioutil.WriteFile("/supervisor/supervisor_services.yml", data, 0777)
 		} else {
 			logger.Info("Update is not ready.")
 
@@ -386,6 +466,81 @@ func StartSupervisor(ctx context.Context, supervisor *RosSupervisor, dockeClient
 	}
 }
 
+// Commits of the repositories of a service, either those deployed or those
+// found upstream
+func (s SupervisorService) Commits(upstream bool) string {
+	commits := []string{}
+	for _, repo := range s.Repos {
+		if upstream && repo.UpstreamCommit != "" {
+			commits = append(commits, repo.UpstreamCommit)
+		} else {
+			commits = append(commits, repo.CurrentCommit)
+		}
+	}
+	return strings.Join(commits, ",")
+}
+
+// Commit of the repository a service is built from when its build context is
+// a git repository tracked by the service, either the deployed one or the one
+// found upstream. Empty if the context is not tracked
+func (s SupervisorService) BuildRevision(targetService *docker.Service, upstream bool) string {
+	if targetService.BuildOpt.Context == "" {
+		return ""
+	}
+	remote := normalizeRepoURL(compose.GitContextRemote(targetService.BuildOpt.Context))
+	for _, repo := range s.Repos {
+		if normalizeRepoURL(repo.Url) != remote {
+			continue
+		}
+		if upstream && repo.UpstreamCommit != "" {
+			return repo.UpstreamCommit
+		}
+		return repo.CurrentCommit
+	}
+	return ""
+}
+
+// Repository URL without scheme, credentials and .git suffix so that the
+// different ways of writing it compare equal
+func normalizeRepoURL(url string) string {
+	url = strings.ToLower(strings.TrimSpace(url))
+	if idx := strings.Index(url, "://"); idx >= 0 {
+		url = url[idx+3:]
+	}
+	if idx := strings.LastIndex(url, "@"); idx >= 0 {
+		url = url[idx+1:]
+	}
+	url = strings.Replace(url, ":", "/", 1)
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	return url
+}
+
+// Whether updating the service to the given commits already failed
+func (s SupervisorService) HasFailed(commits string) bool {
+	for _, failed := range s.FailedCommits {
+		if failed == commits {
+			return true
+		}
+	}
+	return false
+}
+
+// Find a service of the project, including core, by its name
+func findService(project *compose.Project, name string) *docker.Service {
+	if name == "" {
+		return nil
+	}
+	if project.Core.Name == name {
+		return &project.Core
+	}
+	for idx := range project.Services {
+		if project.Services[idx].Name == name {
+			return &project.Services[idx]
+		}
+	}
+	return nil
+}
+
 func (s *RosSupervisor) AttachContainers() {
 	for idx := range s.SupervisorServices {
 		for _, service := range s.DockerProject.Services {
@@ -397,20 +552,124 @@ func (s *RosSupervisor) AttachContainers() {
 	}
 }
 
+// Apply changes to the project or the services while no handler reads them.
+// Only the supervisor loop changes them, so it reads them without locking
+func (s *RosSupervisor) update(change func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change()
+}
+
+// ServicesState reports the state and health of the container of every
+// service of the project
+func (s *RosSupervisor) ServicesState(ctx context.Context) []supervisor.ServiceState {
+	output := []supervisor.ServiceState{}
+	logger := s.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	// Containers are inspected on a copy of the services so that the lock is
+	// not held while waiting for the daemon
+	s.mutex.RLock()
+	if s.DockerProject == nil {
+		s.mutex.RUnlock()
+		return output
+	}
+	services := append(docker.Services{s.DockerProject.Core}, s.DockerProject.Services...)
+	s.mutex.RUnlock()
+	for idx := range services {
+		if services[idx].Name == "" {
+			continue
+		}
+		state, err := compose.InspectServiceState(ctx, &services[idx], s.DockerCli, logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to inspect state of service %s with error: %s", services[idx].Name, err))
+		}
+		output = append(output, supervisor.ServiceState{
+			ServiceName:   services[idx].Name,
+			ContainerName: services[idx].Container.Name,
+			ContainerID:   services[idx].Container.ID,
+			Status:        state.Status,
+			Health:        state.Health,
+		})
+	}
+	return output
+}
+
+// ExportEnabled tells whether the project can be exported
+func (s *RosSupervisor) ExportEnabled() bool {
+	return s.AllowExport
+}
+
+// ExportProject serializes the deployed project as a compose file
+func (s *RosSupervisor) ExportProject(ctx context.Context) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.DockerProject == nil {
+		return nil, errors.New("no project is deployed")
+	}
+	return compose.MarshalProject(s.DockerProject)
+}
+
+// ListBuilds lists the recorded builds, most recent first
+func (s *RosSupervisor) ListBuilds(ctx context.Context, service string) ([]supervisor.Build, error) {
+	records, err := compose.ListBuilds(service)
+	if err != nil {
+		return nil, err
+	}
+	builds := []supervisor.Build{}
+	for _, record := range records {
+		builds = append(builds, toBuild(record))
+	}
+	return builds, nil
+}
+
+// GetBuild reads the record of a build
+func (s *RosSupervisor) GetBuild(ctx context.Context, id string) (supervisor.Build, bool, error) {
+	record, err := compose.GetBuild(id)
+	if err == compose.ErrBuildNotFound {
+		return supervisor.Build{}, false, nil
+	}
+	if err != nil {
+		return supervisor.Build{}, false, err
+	}
+	return toBuild(record), true, nil
+}
+
+// WriteBuildLog writes the log of a build, see compose.WriteBuildLog
+func (s *RosSupervisor) WriteBuildLog(ctx context.Context, id string, tail int, follow bool, w io.Writer) error {
+	return compose.WriteBuildLog(ctx, id, tail, follow, w)
+}
+
+func toBuild(record compose.BuildRecord) supervisor.Build {
+	build := supervisor.Build{
+		ID:        record.ID,
+		Service:   record.Service,
+		Commit:    record.Commit,
+		ImageID:   record.ImageID,
+		Status:    record.Status,
+		Error:     record.Error,
+		StartedAt: record.StartedAt.Format(time.RFC3339),
+	}
+	if record.FinishedAt != nil {
+		build.FinishedAt = record.FinishedAt.Format(time.RFC3339)
+	}
+	return build
+}
+
 func (s *RosSupervisor) DisplayProject() {
-	fmt.Printf("DOCKER PROJECT \n")
-	compose.DisplayProject(s.DockerProject)
-	fmt.Printf("SUPERVISOR CONFIG \n")
+	s.Logger.Debug("DOCKER PROJECT")
+	compose.DisplayProject(s.DockerProject, s.Logger)
+	s.Logger.Debug("SUPERVISOR CONFIG")
 	for _, service := range s.SupervisorServices {
-		fmt.Printf("Service Name: %s\n", service.ServiceName)
-		fmt.Printf("Container Name: %s\n", service.ContainerName)
+		s.Logger.Debug(fmt.Sprintf("Service Name: %s", service.ServiceName))
+		s.Logger.Debug(fmt.Sprintf("Container Name: %s", service.ContainerName))
 		for _, repo := range service.Repos {
-			fmt.Printf("Repo name: %s\n", repo.Name)
-			fmt.Printf("Owner name: %s\n", repo.Owner)
-			fmt.Printf("URL: %s\n", repo.Url)
-			fmt.Printf("Branch name: %s\n", repo.Branch)
-			fmt.Printf("Local Commit: %s\n", repo.CurrentCommit)
+			s.Logger.Debug(fmt.Sprintf("Repo name: %s", repo.Name))
+			s.Logger.Debug(fmt.Sprintf("Owner name: %s", repo.Owner))
+			s.Logger.Debug(fmt.Sprintf("URL: %s", repo.Url))
+			s.Logger.Debug(fmt.Sprintf("Branch name: %s", repo.Branch))
+			s.Logger.Debug(fmt.Sprintf("Local Commit: %s", repo.CurrentCommit))
 		}
-		fmt.Printf("===== \n")
 	}
 }